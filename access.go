@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Access holds the IP ranges that are allowed to connect and the ones that are
+// blocked, loaded from the -allowlist and -blocklist files.
+type Access struct {
+	sync.RWMutex
+	// AllowPath and BlockPath are the files the ranges are loaded from, empty
+	// if the list isn't used
+	AllowPath string
+	BlockPath string
+	// Allow is the ranges that can connect, if it's empty everyone can
+	Allow []*net.IPNet
+	// Block is the ranges that can't connect, even if they're allowed
+	Block []*net.IPNet
+}
+
+// Lists is the global allowlist and blocklist.
+var Lists = &Access{}
+
+// Load reads both lists from their files, replacing the ones already loaded.
+// If either file can't be read nothing is replaced, so a bad edit doesn't
+// open the server up or lock everyone out.
+func (a *Access) Load() error {
+	var (
+		allow []*net.IPNet
+		block []*net.IPNet
+		err   error
+	)
+
+	if a.AllowPath != "" {
+		if allow, err = LoadRanges(a.AllowPath); err != nil {
+			return err
+		}
+	}
+	if a.BlockPath != "" {
+		if block, err = LoadRanges(a.BlockPath); err != nil {
+			return err
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.Allow, a.Block = allow, block
+
+	return nil
+}
+
+// Allowed determines whether or not ip can connect. Blocked ranges win over
+// allowed ones.
+func (a *Access) Allowed(ip string) bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		// only an allowlist can turn away an address it can't read
+		return a.Allow == nil
+	}
+
+	for _, block := range a.Block {
+		if block.Contains(parsed) {
+			return false
+		}
+	}
+
+	if a.Allow == nil {
+		return true
+	}
+	for _, allow := range a.Allow {
+		if allow.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Wrap returns a handler that turns away IPs that aren't allowed with a 403
+// before handler is called.
+func (a *Access) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Allowed(RequestIP(r)) {
+			http.Error(
+				w,
+				http.StatusText(http.StatusForbidden),
+				http.StatusForbidden,
+			)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// LoadRanges reads a file with a CIDR range on each line. A plain IP is a
+// range of just that IP, and blank lines and lines starting with # are
+// skipped.
+func LoadRanges(path string) ([]*net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranges := make([]*net.IPNet, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// a plain IP is the smallest range that holds it
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ipNet)
+	}
+
+	return ranges, scanner.Err()
+}
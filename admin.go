@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admin wraps an admin handler so it's only called when the request has the
+// admin token as a bearer token. A missing token gets a 401 and a wrong one
+// gets a 403.
+func Admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(
+			r.Header.Get("Authorization"),
+			"Bearer ",
+		)
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing admin token", http.StatusUnauthorized)
+			return
+		}
+
+		// compare in constant time so the token can't be guessed a
+		// character at a time
+		if subtle.ConstantTimeCompare(
+			[]byte(token),
+			[]byte(AdminToken),
+		) != 1 {
+			http.Error(w, "wrong admin token", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// AdminConvos is called for https://DOMAIN/admin/convos/convoId. A DELETE
+// forcibly ends the conversation, telling both users it was closed.
+func AdminConvos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(
+			w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	convoId := NormalizeId(
+		strings.TrimPrefix(r.URL.Path, "/admin/convos/"),
+	)
+
+	if err := Store.EndConvo(
+		convoId,
+		"conversation closed by an admin",
+	); err != nil {
+		Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminStats is called for https://DOMAIN/stats. It always returns JSON with
+// the room summary and how long the server has been up, for dashboards.
+func AdminStats(w http.ResponseWriter, r *http.Request) {
+	stats := struct {
+		Summary
+		// Uptime is how long the server has been up, in whole seconds
+		Uptime int64 `json:"uptime"`
+	}{
+		Summary: Store.Summary(),
+		Uptime:  int64(time.Since(StartTime).Seconds()),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// AdminDebug returns the handler for https://DOMAIN/convoId/debug. It returns
+// JSON with a snapshot of the conversation, for working out why users aren't
+// seeing the same thing.
+func AdminDebug(convoId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := Store.Snapshot(convoId)
+		if err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// API_KEY_HEADER is the header the API key can be sent in, it can also be
+// sent as a bearer token.
+const API_KEY_HEADER = "X-API-Key"
+
+// ErrAPIKey is returned when a request that needs the API key doesn't have
+// it, or has the wrong one.
+var ErrAPIKey = errors.New("missing or wrong api key")
+
+var (
+	// APIKey is the key needed to send messages, anyone can if it's empty
+	APIKey string
+	// APIKeyReads is whether or not the key is also needed to read messages
+	APIKeyReads bool
+)
+
+// CheckAPIKey makes sure a request has the API key, if there is one. It's
+// read from API_KEY_HEADER first and the Authorization header second.
+func CheckAPIKey(r *http.Request) error {
+	if APIKey == "" {
+		return nil
+	}
+
+	key := r.Header.Get(API_KEY_HEADER)
+	if key == "" {
+		key, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	// compare in constant time so the key can't be guessed a character at
+	// a time
+	if key == "" ||
+		subtle.ConstantTimeCompare([]byte(key), []byte(APIKey)) != 1 {
+		return ErrAPIKey
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+// Check runs the startup checks that can only fail once the server tries to
+// serve, for -check. Each check is printed with whether it passed, and Check
+// returns false if any of them failed. The flags themselves have already been
+// validated by the time it's called.
+// The redirect listener's address is only checked if redirectAddr isn't empty.
+func Check(certFile, keyFile, addr, redirectAddr string) bool {
+	var (
+		ok = true
+		// result prints the outcome of a single check
+		result = func(name string, err error) {
+			if err != nil {
+				ok = false
+				fmt.Fprintf(os.Stdout, "FAIL %s: %s\n", name, err)
+				return
+			}
+			fmt.Fprintf(os.Stdout, "ok   %s\n", name)
+		}
+		// bind makes sure addr is free by listening on it for a moment
+		bind = func(addr string) error {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			return listener.Close()
+		}
+	)
+
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	result("certificate and key "+certFile+" "+keyFile, err)
+
+	result(addr+" is free", bind(addr))
+	if redirectAddr != "" {
+		result(redirectAddr+" is free", bind(redirectAddr))
+	}
+
+	// the URL is sent in every link, so it has to be one people can follow
+	parsed, err := url.Parse(URL)
+	if err == nil && (parsed.Scheme != "https" || parsed.Host == "") {
+		err = fmt.Errorf("%q isn't an https URL with a host", URL)
+	}
+	result("url "+URL, err)
+
+	return ok
+}
@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// Clock tells the time for the parts of the server that wait on it or compare
+// against it, so they can be run against a clock that's moved by hand instead.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel that gets the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine once d has passed, unless the
+	// returned Timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call waiting for its time to come, from Clock.AfterFunc.
+type Timer interface {
+	// Stop cancels the call, it returns false if it's too late.
+	Stop() bool
+}
+
+// RealClock is the Clock that tells the actual time.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// After returns time.After(d).
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// AfterFunc returns time.AfterFunc(d, f).
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a call waiting on a fakeClock.
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+}
+
+// newFakeClock returns a fakeClock starting at the current time.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	fired := make(chan time.Time, 1)
+	c.AfterFunc(d, func() { fired <- c.Now() })
+
+	return fired
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+
+	return timer
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Advance moves the clock forward by d, calling everything that was waiting
+// for it.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	waiting := c.timers[:0]
+	due := make([]*fakeTimer, 0)
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			waiting = append(waiting, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = waiting
+	c.Unlock()
+
+	for _, timer := range due {
+		go timer.f()
+	}
+}
+
+// wait waits for n calls to be waiting on the clock, since the goroutines
+// that wait on it start in their own time.
+func (c *fakeClock) wait(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(STREAM_TIMEOUT)
+	for {
+		c.Lock()
+		count := len(c.timers)
+		c.Unlock()
+
+		if count >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls are waiting on the clock, want %d", count, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	setGlobal(t, &MessageTTL, time.Minute)
+	server := newTestServer(t)
+	clock := newFakeClock()
+	Store.Clock = clock
+	convo := server.convo(t)
+
+	url := convo.alice.put(convo.id, "hello")
+	convo.bobStream.expect("+ 1 " + url)
+
+	// not yet
+	clock.wait(t, 1)
+	clock.Advance(MessageTTL / 2)
+	clock.wait(t, 1)
+	if count := messageCount(t, convo.id); count != 1 {
+		t.Fatalf("conversation has %d messages, want 1", count)
+	}
+
+	clock.Advance(MessageTTL)
+	convo.bobStream.expect("x " + url)
+	if count := messageCount(t, convo.id); count != 0 {
+		t.Fatalf("conversation has %d messages, want 0", count)
+	}
+}
+
+func TestReconnectGraceTeardown(t *testing.T) {
+	setGlobal(t, &MessageTTL, 0)
+	setGlobal(t, &ReconnectGrace, time.Minute)
+	server := newTestServer(t)
+	clock := newFakeClock()
+	Store.Clock = clock
+
+	aliceStream, convoId := server.client(t, "10.0.0.1").create()
+	aliceStream.close()
+
+	// the conversation waits for alice to come back
+	clock.wait(t, 1)
+	clock.Advance(ReconnectGrace - time.Second)
+	if !Store.IsConvo(convoId) {
+		t.Fatal("conversation was deleted before the grace period ended")
+	}
+
+	clock.Advance(time.Second)
+	deadline := time.Now().Add(STREAM_TIMEOUT)
+	for Store.IsConvo(convoId) {
+		if time.Now().After(deadline) {
+			t.Fatal("conversation wasn't deleted after the grace period")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	setGlobal(t, &MessageTTL, 0)
+	setGlobal(t, &PingDots, false)
+	setGlobal(t, &IdleTimeout, time.Minute)
+	server := newTestServer(t)
+	clock := newFakeClock()
+	Store.Clock = clock
+	go Store.Ping()
+	convo := server.convo(t)
+
+	// a message keeps the conversation going
+	clock.wait(t, 1)
+	clock.Advance(IdleTimeout / 2)
+	convo.alice.put(convo.id, "hello")
+	clock.wait(t, 1)
+	clock.Advance(IdleTimeout / 2)
+	clock.wait(t, 1)
+	if !Store.IsConvo(convo.id) {
+		t.Fatal("conversation ended while it was in use")
+	}
+
+	// but nothing for a whole IdleTimeout ends it
+	clock.Advance(IdleTimeout)
+	convo.aliceStream.expect("  1 ")
+	convo.aliceStream.expect("* conversation timed out")
+	convo.aliceStream.ended()
+}
+
+func TestPingStops(t *testing.T) {
+	room := NewRoom(newFakeClock())
+
+	stopped := make(chan struct{})
+	go func() {
+		room.Ping()
+		close(stopped)
+	}()
+
+	room.Close()
+	select {
+	case <-stopped:
+	case <-time.After(STREAM_TIMEOUT):
+		t.Fatal("Ping kept going after the room was closed")
+	}
+
+	// closing it again does nothing
+	room.Close()
+}
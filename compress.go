@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// GZIP_MIN_BYTES is the smallest body that's worth compressing, anything
+	// smaller can come out bigger than it went in.
+	GZIP_MIN_BYTES = 1024
+	// STREAM_CHUNK_BYTES is how much of a streamed body is written before
+	// it's flushed to the client.
+	STREAM_CHUNK_BYTES = 32 * 1024
+)
+
+// Gzip is whether or not bodies are compressed for clients that accept it.
+var Gzip bool = true
+
+// WriteBody writes data as the whole response body, gzipped if the client
+// accepts it and data is big enough to be worth it. The Content-Type has to
+// be set before calling WriteBody, gzipped data can't be sniffed.
+//
+// This is only for bodies that are written all at once, the event stream is
+// never compressed because gzip would hold events back until it had enough
+// to compress.
+func WriteBody(w http.ResponseWriter, r *http.Request, data []byte) {
+	WriteBodyStatus(w, r, http.StatusOK, data)
+}
+
+// WriteBodyStatus writes data as the whole response body like WriteBody does,
+// with status instead of 200.
+func WriteBodyStatus(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	data []byte,
+) {
+	if Gzip {
+		// caches need to know the body depends on Accept-Encoding
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if len(data) >= GZIP_MIN_BYTES &&
+			strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			var buf bytes.Buffer
+
+			// writing to a bytes.Buffer can't fail
+			gz := gzip.NewWriter(&buf)
+			gz.Write(data)
+			gz.Close()
+
+			data = buf.Bytes()
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// StreamBody writes data as the whole response body like WriteBody does, but
+// a chunk at a time, flushing each one. The client starts getting a big body
+// right away, and it's compressed as it goes rather than copied all at once.
+// It returns an error if the client didn't get all of it.
+func StreamBody(w http.ResponseWriter, r *http.Request, data []byte) error {
+	var (
+		rc  = http.NewResponseController(w)
+		out io.Writer
+		gz  *gzip.Writer
+	)
+
+	out = w
+	if Gzip {
+		// caches need to know the body depends on Accept-Encoding
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if len(data) >= GZIP_MIN_BYTES &&
+			strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gz = gzip.NewWriter(w)
+			out = gz
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	// the compressed length isn't known until it's done
+	if gz == nil {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+
+	// the deadline is for each chunk, a big body on a slow connection can
+	// take as long as it needs while it's moving
+	defer rc.SetWriteDeadline(time.Time{})
+
+	for len(data) > 0 {
+		chunk := data[:min(len(data), STREAM_CHUNK_BYTES)]
+		data = data[len(chunk):]
+
+		if WriteTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+		}
+		if _, err := out.Write(chunk); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// a client that went away might not have made the writes fail yet
+	return r.Context().Err()
+}
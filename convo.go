@@ -2,9 +2,57 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// PING_INTERVAL_HEADER is the header a creator can set to choose how
+	// often their conversation is pinged, like "30s"
+	PING_INTERVAL_HEADER = "X-Ping-Interval"
+	// MIN_PING_INTERVAL and MAX_PING_INTERVAL are the range a chosen ping
+	// interval is kept in, pinging more often floods the users and less often
+	// lets connections time out
+	MIN_PING_INTERVAL = time.Second * 5
+	MAX_PING_INTERVAL = time.Minute * 5
+	// PING_TICK is how often the room checks which conversations are due a
+	// ping, so an interval can be off by up to this much
+	PING_TICK = time.Second
+)
+
+var (
+	// ErrBadPingInterval is returned when a chosen ping interval isn't a
+	// positive duration.
+	ErrBadPingInterval = errors.New(
+		"ping interval must be a positive duration like 30s",
+	)
+	// ErrConvoStorageFull is returned when a conversation already holds as
+	// many unread messages, or bytes of them, as it's allowed.
+	ErrConvoStorageFull = errors.New(
+		"too many unread messages, wait for some to be read",
+	)
+	// ErrServerStorageFull is returned when every conversation together
+	// already holds as many bytes of messages as the server allows.
+	ErrServerStorageFull = errors.New(
+		"server has too many messages, try again later",
+	)
+	// ErrNoUsers is returned by Broadcast when no one is connected to get
+	// the event right away.
+	ErrNoUsers = errors.New("no users in conversation")
+)
+
+// Delivery is an event waiting to be written to a user. Events are queued
+// while the room is locked and written once it's unlocked, so a slow user
+// can't hold up the whole room.
+type Delivery struct {
+	User  *User
+	Event Event
+}
+
 // Convo is the container for a conversation.
 type Convo struct {
 	// ConvoId is the unique conversation id needed to access the conversation
@@ -12,125 +60,551 @@ type Convo struct {
 	// Users is the array containing both parties of the conversation, some
 	// may be nil
 	Users [2]*User
+	// Creator is the IP of the user who created the conversation, they can
+	// do things the other user can't (like kick them)
+	Creator string
+	// Password is the hash of the password needed to join, nil if there
+	// isn't one
+	Password *Password
+	// Interval is how often the conversation pings its users
+	Interval time.Duration
+	// LastPing is when the conversation last pinged its users
+	LastPing time.Time
+	// Teardown deletes the conversation once the last user has had a chance
+	// to reconnect, it's nil unless the conversation is empty and waiting
+	Teardown Timer
+	// Queue is the users waiting for a slot, first come first served
+	Queue []*User
+	// LastIPs is the IP of the last user in each slot, so someone can be put
+	// back in their own slot when they rejoin
+	LastIPs [2]string
+	// Kicked is the IPs the creator kicked out, they can't join again
+	Kicked map[string]bool
+	// Seq is the id of the last event sent in the conversation
+	Seq uint64
+	// Backlog holds the most recent events sent to each slot, including the
+	// ones sent while the slot's user was disconnected
+	Backlog [2][]Event
+	// Clock tells the time for the conversation's timers and timestamps
+	Clock Clock
+	// CreatedAt is when the conversation was created
+	CreatedAt time.Time
+	// LastActivity is when a message was last added or read
+	LastActivity time.Time
 	// Messages contains unread messages of the conversation, where the
-	// messageId is the key and the value is the raw data of the message
-	Messages map[string][]byte
-	// Stop is just to notify the pinging goroutine to stop (when the
-	// conversation is deleted)
+	// messageId is the key, and read ones too if KeepHistory is set
+	Messages map[string]*Message
+	// Unread is the number of unread messages
+	Unread int
+	// MessageSeq is the Seq of the last message added to the conversation,
+	// which is also how many messages have been sent in it
+	MessageSeq uint64
+	// Bytes is the total size of the unread messages
+	Bytes int64
+	// History is the total size of the read messages kept in the history
+	History int64
+	// Total points at the room's count of the bytes of messages held by
+	// every conversation, read or not, nil while the conversation isn't in a
+	// room
+	Total *int64
+	// Stop is just closed to notify the expiring and join goroutines to stop
+	// (when the conversation is deleted)
 	Stop chan struct{}
+	// Outbox holds the events sent while the room is locked, until they can
+	// be written to the users
+	Outbox []Delivery
+	// Ending holds the users whose streams end once the outbox is written
+	Ending []*User
+	// Delivering is held while the outbox is written, so events reach the
+	// users in the order they were sent even though the room is unlocked
+	Delivering sync.Mutex
+}
+
+// ParsePingInterval reads the ping interval a creator chose, and keeps it
+// between MIN_PING_INTERVAL and MAX_PING_INTERVAL. It returns zero if none was
+// chosen, for the server default.
+func ParsePingInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, ErrBadPingInterval
+	}
+
+	return min(max(interval, MIN_PING_INTERVAL), MAX_PING_INTERVAL), nil
+}
+
+// NewConvo creates a new conversation with convoId and no users that tells
+// the time with clock, the real time if clock is nil.
+func NewConvo(convoId string, clock Clock) *Convo {
+	if clock == nil {
+		clock = RealClock{}
+	}
+
+	return &Convo{
+		ConvoId:      convoId,
+		Messages:     make(map[string]*Message, 0),
+		Kicked:       make(map[string]bool, 0),
+		Stop:         make(chan struct{}),
+		Interval:     PingInterval,
+		LastPing:     clock.Now(),
+		Clock:        clock,
+		CreatedAt:    clock.Now(),
+		LastActivity: clock.Now(),
+	}
+}
+
+// LogSummary logs what happened in the conversation once it's over, if
+// LogSummaries is set.
+func (c *Convo) LogSummary() {
+	if !LogSummaries {
+		return
+	}
+
+	slog.Info(
+		"convo summary",
+		"convoId", c.ConvoId,
+		"messages", c.MessageSeq,
+		"duration", c.Clock.Now().Sub(c.CreatedAt).Round(time.Second),
+		"ips", strings.Join(c.IPs(), ","),
+	)
+}
+
+// IPs returns the IP of the last user in each slot that someone has been in.
+func (c *Convo) IPs() []string {
+	// a slot no one was ever in has no ip
+	ips := make([]string, 0, len(c.LastIPs))
+	for _, ip := range c.LastIPs {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+// Name returns who the user with ip is in notifications, by the nickname of
+// the user connected with it if there is one.
+func (c *Convo) Name(ip string) string {
+	for _, user := range c.Users {
+		if user != nil && user.IP == ip {
+			return user.Name()
+		}
+	}
+
+	return DefaultName(c.ConvoId, ip)
+}
+
+// Start starts the goroutines that expire messages and end the conversation
+// if no one joins, which run until Stop is closed. The conversation is pinged
+// by the room while it's in it, so there's no goroutine for that.
+func (c *Convo) Start() {
+	// start the expire goroutine, unless messages live forever
+	if MessageTTL > 0 {
+		go c.Expire(MessageTTL)
+	}
+	// start the join goroutine, unless someone has already joined
+	if JoinTimeout > 0 && c.LastIPs[1] == "" {
+		go c.AwaitJoin(JoinTimeout)
+	}
+}
+
+// AwaitJoin is a goroutine that ends the conversation if no one has joined the
+// creator after timeout.
+func (c *Convo) AwaitJoin(timeout time.Duration) {
+	select {
+	// end the goroutine
+	case <-c.Stop:
+	case <-c.Clock.After(timeout):
+		Store.EndUnjoinedConvo(c.ConvoId)
+	}
 }
 
-// Ping is a goroutine that continuously pings each user in the conversation.
-//
-// TODO: This function serves to make sure the client's connection isn't closed
-//		 but there are probably better ways to do that. Check net/http settings
-//		 to see if I can change the timeout settings for the web server.
-func (c *Convo) Ping() {
+// Expire is a goroutine that continuously deletes messages that have gone
+// unread for longer than ttl.
+func (c *Convo) Expire(ttl time.Duration) {
 	for {
 		select {
 		// end the goroutine
 		case <-c.Stop:
 			return
-		// ping every 30 seconds
-		case <-time.After(time.Second * 30):
-			c.Broadcast([]byte("."))
+		// check often enough that messages don't outlive their ttl by much
+		case <-c.Clock.After(ttl / 10):
+			Store.ExpireMessages(c.ConvoId)
 		}
 	}
 }
 
 // CreateMessage creates a new message from raw data and adds it to the
 // conversation. It returns the new messageId, and might return an error.
-// There might be an error from a problem generating the new messageId, or a
-// messageId collision.
-//
-// TODO: Figure out how to handle messageId collisions recursively? It
-//       shouldn't be a problem, but might be cool to explore as an exercise.
-//    -> extend fnv hash size
-func (c *Convo) CreateMessage(data []byte) (string, error) {
+// There might be an error from a problem generating the new messageId, or
+// every messageId generated colliding with an existing message.
+func (c *Convo) CreateMessage(
+	data []byte,
+	tag, contentType, ip string,
+) (string, error) {
 	var (
 		err error
 		// messageId will be populated with the new messageId
 		messageId string
-		ok        bool
 	)
 
-	// attempt to generate a new messageId using the data as salt
-	if messageId, err = NewId(data); err != nil {
-		return "", err
+	// someone who never reads could otherwise make the other user hold on to
+	// messages forever
+	if (MaxConvoMessages > 0 && c.Unread >= MaxConvoMessages) ||
+		(MaxConvoBytes > 0 && c.Bytes+int64(len(data)) > MaxConvoBytes) {
+		return "", ErrConvoStorageFull
+	}
+	c.Evict(1, int64(len(data)))
+	if !c.Fits(int64(len(data))) {
+		return "", ErrServerStorageFull
 	}
 
-	// check if a message with the newly generated messageId already exists,
-	// because a messageId collision would be bad
-	if _, ok = c.Messages[messageId]; ok {
-		return "", errors.New("message id overwrite")
+	// attempt to generate a new random messageId, trying again if a message
+	// with it already exists because a messageId collision would be bad
+	if messageId, err = UniqueId(data, func(id string) bool {
+		_, ok := c.Messages[id]
+		return ok
+	}); err != nil {
+		return "", err
 	}
 
 	// add the new message to the conversation message map
-	c.Messages[messageId] = data
+	c.Messages[messageId] = NewMessage(
+		data,
+		tag,
+		contentType,
+		ip,
+		c.Clock.Now(),
+		MessageTTL,
+	)
+	c.MessageSeq++
+	c.Messages[messageId].Seq = c.MessageSeq
+	c.Unread++
+	c.Bytes += int64(len(data))
+	if c.Total != nil {
+		*c.Total += int64(len(data))
+	}
 
 	return messageId, nil
 }
 
-// ReadMessage simply retrieves the raw data from a messageId.
-func (c *Convo) ReadMessage(messageId string) []byte {
-	return c.Messages[messageId]
+// Fits determines whether or not bytes more of messages can be held without
+// going over MaxTotalBytes.
+func (c *Convo) Fits(bytes int64) bool {
+	return MaxTotalBytes == 0 || c.Total == nil ||
+		*c.Total+bytes <= MaxTotalBytes
+}
+
+// Release stops counting the conversation's messages towards the room's
+// total, once it's been taken out of the room. Calling it again does nothing.
+func (c *Convo) Release() {
+	if c.Total == nil {
+		return
+	}
+
+	for _, message := range c.Messages {
+		*c.Total -= int64(len(message.Data))
+	}
+	c.Total = nil
+}
+
+// DeleteMessage deletes a message from the conversation, if it exists.
+func (c *Convo) DeleteMessage(messageId string) {
+	if message, ok := c.Messages[messageId]; ok {
+		delete(c.Messages, messageId)
+		if c.Total != nil {
+			*c.Total -= int64(len(message.Data))
+		}
+		if message.Read {
+			c.History -= int64(len(message.Data))
+		} else {
+			c.Unread--
+			c.Bytes -= int64(len(message.Data))
+		}
+	}
+}
+
+// MarkRead marks a message as read but keeps it in the conversation's
+// history, so it no longer counts against the unread limits. It still counts
+// against the conversation's limits until Evict makes room for new messages.
+func (c *Convo) MarkRead(messageId string) {
+	if message, ok := c.Messages[messageId]; ok && !message.Read {
+		message.Read = true
+		c.Unread--
+		c.Bytes -= int64(len(message.Data))
+		c.History += int64(len(message.Data))
+	}
+}
+
+// Evict deletes the oldest read messages from the history until count more
+// messages of bytes more can be held without going over MaxConvoMessages and
+// MaxConvoBytes, so the history can't grow forever. The users are told the
+// evicted messages expired, since they can't be read again either way.
+func (c *Convo) Evict(count int, bytes int64) {
+	// only read messages can be evicted
+	for c.Unread < len(c.Messages) {
+		if (MaxConvoMessages == 0 ||
+			len(c.Messages)+count <= MaxConvoMessages) &&
+			(MaxConvoBytes == 0 ||
+				c.Bytes+c.History+bytes <= MaxConvoBytes) {
+			return
+		}
+
+		// find the read message that was sent first
+		var oldest *Message
+		oldestId := ""
+		for messageId, message := range c.Messages {
+			if message.Read && (oldest == nil || message.Seq < oldest.Seq) {
+				oldest, oldestId = message, messageId
+			}
+		}
+		if oldest == nil {
+			return
+		}
+
+		c.DeleteMessage(oldestId)
+		c.Broadcast(Event{
+			Type: EVENT_EXPIRED,
+			URL:  URL + c.ConvoId + "/" + oldestId,
+		})
+	}
+}
+
+// ReadMessage simply retrieves a message from a messageId. Messages that have
+// expired but haven't been deleted yet are treated as missing.
+func (c *Convo) ReadMessage(messageId string) *Message {
+	message, ok := c.Messages[messageId]
+	if !ok || message.Expired(c.Clock.Now()) {
+		return nil
+	}
+
+	return message
+}
+
+// AddMessages adds each of messages like AddMessage, and returns their
+// messageIds in the same order. The storage limits are checked for the whole
+// batch first, so a batch that doesn't fit isn't half added.
+func (c *Convo) AddMessages(
+	messages [][]byte,
+	contentType, ip string,
+) ([]string, error) {
+	var bytes int64
+	for _, data := range messages {
+		bytes += int64(len(data))
+	}
+	if (MaxConvoMessages > 0 && c.Unread+len(messages) > MaxConvoMessages) ||
+		(MaxConvoBytes > 0 && c.Bytes+bytes > MaxConvoBytes) {
+		return nil, ErrConvoStorageFull
+	}
+	c.Evict(len(messages), bytes)
+	if !c.Fits(bytes) {
+		return nil, ErrServerStorageFull
+	}
+
+	messageIds := make([]string, 0, len(messages))
+	for _, data := range messages {
+		messageId, err := c.AddMessage(data, "", contentType, ip)
+		if err != nil {
+			return messageIds, err
+		}
+		messageIds = append(messageIds, messageId)
+	}
+
+	return messageIds, nil
 }
 
 // AddMessage notifies each user in the conversation when a message has been
-// added. It returns an error if c.CreateMessage doesn't work with the data
-// provided in the params.
-func (c *Convo) AddMessage(data []byte, ip string) error {
+// added, and returns the new messageId. It returns an error if
+// c.CreateMessage doesn't work with the data provided in the params.
+func (c *Convo) AddMessage(
+	data []byte,
+	tag, contentType, ip string,
+) (string, error) {
 	var (
 		err error
 		// messageId will be populated with the new unique id of the message
 		messageId string
-		// notify sends a notification message to a user and determines whether
-		// or not it is coming from them or not (by checking IP)
-		notify = func(user *User) {
-			var self string
-			// if the message is from self, start the line with " ", if it is
-			// coming from someone else, start the line with "+" to indicate
-			// a new message has been added to the conversation
-			if self = "  "; user.IP != ip {
-				self = "+ "
-			}
-			// write the new message notification to the user directly
-			user.Write([]byte(self + URL + c.ConvoId + "/" + messageId))
+		// notify sends a notification message to a slot and determines
+		// whether or not it is coming from them or not (by checking IP)
+		notify = func(userId int) {
+			// send the new message notification to the slot directly
+			c.Send(userId, Event{
+				Type: EVENT_MESSAGE,
+				Seq:  c.Messages[messageId].Seq,
+				URL:  URL + c.ConvoId + "/" + messageId,
+				From: c.Name(ip),
+				Self: c.LastIPs[userId] == ip,
+			})
 		}
 	)
 
 	// attempt to create a new message with the provided data and store the new
 	// messageId, otherwise return the error
-	if messageId, err = c.CreateMessage(data); err != nil {
-		return err
+	if messageId, err = c.CreateMessage(
+		data,
+		tag,
+		contentType,
+		ip,
+	); err != nil {
+		return "", err
 	}
+	c.LastActivity = c.Clock.Now()
+	Hooks.Notify(HOOK_MESSAGE, c)
 
-	// notify users that are present in the conversation
-	if c.Users[0] != nil {
-		notify(c.Users[0])
+	// notify both slots, users that are disconnected can catch up later
+	notify(0)
+	notify(1)
+
+	// let the sender know if no one was there to get the notification right
+	// away, they'll only see it if they come back
+	for userId := range c.Users {
+		if c.Users[userId] != nil && c.Users[userId].IP == ip &&
+			c.Users[OtherUserId(userId)] == nil {
+			c.Send(userId, Event{
+				Type: EVENT_UNDELIVERED,
+				URL:  URL + c.ConvoId + "/" + messageId,
+				Text: "not delivered, peer offline",
+			})
+		}
 	}
-	if c.Users[1] != nil {
-		notify(c.Users[1])
+
+	return messageId, nil
+}
+
+// Alert tells the users other than the one with ip about an error they can do
+// something about. Errors aren't part of the event sequence, so they're lost if
+// no one is connected.
+func (c *Convo) Alert(ip, text string) {
+	for _, user := range c.Users {
+		if user != nil && user.IP != ip {
+			c.Outbox = append(c.Outbox, Delivery{
+				User:  user,
+				Event: Event{Type: EVENT_ERROR, Text: text},
+			})
+		}
 	}
+}
 
-	return nil
+// AlertFailed tells the other user when the user with ip couldn't send a
+// message because of err, if reading their messages would make room for it.
+func (c *Convo) AlertFailed(ip string, err error) {
+	if err == ErrConvoStorageFull || err == ErrServerStorageFull {
+		c.Alert(ip, c.Name(ip)+" couldn't send a message: "+err.Error())
+	}
 }
 
-// Broadcast sends data to each user in the conversation. It returns an error
-// if there are no users in the conversation, which hopefully never happens
-// because that would mean conversations aren't being deleted properly.
-func (c *Convo) Broadcast(data []byte) error {
-	// check if there are no users in the conversation, which would be bad
-	if c.Users[0] == nil && c.Users[1] == nil {
-		return errors.New("no users in conversation")
+// Pending returns a notice listing the unread messages waiting for the user
+// with ip, in the order they were sent, or nil if there aren't any. It's
+// written when the user joins, so someone coming back knows what's waiting
+// for them.
+func (c *Convo) Pending(ip string) *Event {
+	pending := make([]*Message, 0)
+	urls := make(map[*Message]string, 0)
+	for messageId, message := range c.Messages {
+		// the user's own messages are waiting for someone else
+		if message.From == ip || message.Read ||
+			message.Expired(c.Clock.Now()) {
+			continue
+		}
+		pending = append(pending, message)
+		urls[message] = URL + c.ConvoId + "/" + messageId
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Seq < pending[j].Seq
+	})
+
+	list := make([]string, len(pending))
+	for i, message := range pending {
+		list[i] = urls[message]
+	}
+
+	return &Event{
+		Type: EVENT_NOTICE,
+		Text: fmt.Sprintf(
+			"%d unread: %s",
+			len(pending),
+			strings.Join(list, " "),
+		),
+	}
+}
+
+// Slot returns the empty slot a user joining from ip should be put in, or -1
+// if both slots are taken. Someone coming back gets the slot they had before,
+// and someone new gets a slot no one has had if there is one, so they don't
+// take the slot of someone who might still come back.
+func (c *Convo) Slot(ip string) int {
+	var slot = -1
+
+	for userId := range c.Users {
+		if c.Users[userId] != nil {
+			continue
+		}
+		if c.LastIPs[userId] == ip {
+			return userId
+		}
+		if slot == -1 || c.LastIPs[userId] == "" {
+			slot = userId
+		}
 	}
 
-	// write to each user if they are present in the conversation
-	if c.Users[0] != nil {
-		c.Users[0].Write(data)
+	return slot
+}
+
+// Send sends event as the next event to the user in a slot of the
+// conversation. The event is kept in the slot's backlog even if the user is
+// disconnected, so they can catch up when they reconnect.
+func (c *Convo) Send(userId int, event Event) {
+	// no one has been in this slot, so no one needs to catch up on it
+	if c.Users[userId] == nil && c.LastIPs[userId] == "" {
+		return
 	}
-	if c.Users[1] != nil {
-		c.Users[1].Write(data)
+
+	c.Seq++
+	event.Id = c.Seq
+
+	// remember the event, dropping the oldest one if the backlog is full
+	c.Backlog[userId] = append(c.Backlog[userId], event)
+	if len(c.Backlog[userId]) > EVENT_BACKLOG {
+		c.Backlog[userId] = c.Backlog[userId][1:]
+	}
+
+	// queue the event, it's written once the room is unlocked
+	if c.Users[userId] != nil {
+		c.Outbox = append(c.Outbox, Delivery{c.Users[userId], event})
+	}
+}
+
+// Replay returns the events sent to a slot of the conversation after the
+// event with lastId.
+func (c *Convo) Replay(userId int, lastId uint64) []Event {
+	events := make([]Event, 0)
+
+	for _, event := range c.Backlog[userId] {
+		if event.Id > lastId {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// Broadcast sends event to each user in the conversation. It returns
+// ErrNoUsers if no one is connected, which happens while a conversation waits
+// for its last user to reconnect. The event is still kept for them to catch
+// up on.
+func (c *Convo) Broadcast(event Event) error {
+	// send to each slot, so users that are disconnected can catch up later
+	c.Send(0, event)
+	c.Send(1, event)
+
+	if c.Users[0] == nil && c.Users[1] == nil {
+		return ErrNoUsers
 	}
 
 	return nil
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	// EVENT_BACKLOG is how many recent events are kept for each slot of a
+	// conversation, so a user who reconnects can catch up on what they
+	// missed.
+	EVENT_BACKLOG = 100
+
+	// the types of events sent to users
+	EVENT_LINK        = "link"
+	EVENT_MESSAGE     = "message"
+	EVENT_READ        = "read"
+	EVENT_EXPIRED     = "expired"
+	EVENT_CANCELED    = "canceled"
+	EVENT_JOIN        = "join"
+	EVENT_LEAVE       = "leave"
+	EVENT_PING        = "ping"
+	EVENT_NOTICE      = "notice"
+	EVENT_TYPING      = "typing"
+	EVENT_UNDELIVERED = "undelivered"
+	EVENT_ERROR       = "error"
+
+	// why a user left, sent with EVENT_LEAVE
+	LEAVE_LEFT    = "left"
+	LEAVE_DROPPED = "dropped"
+	LEAVE_EXPIRED = "expired"
+	LEAVE_KICKED  = "kicked"
+)
+
+// Event is a single notification sent to a user. It's written as a plaintext
+// line by default, or as a JSON object for clients that ask for JSON.
+type Event struct {
+	// Id is the position of the event in its conversation, zero means the
+	// event isn't part of the sequence (pings, the initial link)
+	Id uint64 `json:"id,omitempty"`
+	// Type is one of the EVENT_ types
+	Type string `json:"type"`
+	// Seq is the position of the message in its conversation, only set for
+	// new messages
+	Seq uint64 `json:"seq,omitempty"`
+	// URL is the conversation or message the event is about
+	URL string `json:"url,omitempty"`
+	// From is the user who caused the event, by their nickname if they have
+	// one and their IP if they don't
+	From string `json:"from,omitempty"`
+	// Self is whether or not the user receiving the event caused it
+	Self bool `json:"self,omitempty"`
+	// Time is when the event happened in RFC3339 (UTC), only set for events
+	// where the time matters to the other user (read, join, leave)
+	Time string `json:"time,omitempty"`
+	// Text is a human readable message from the server, or one of the LEAVE_
+	// reasons for EVENT_LEAVE
+	Text string `json:"text,omitempty"`
+}
+
+// Timestamp formats t the way it's written in events, RFC3339 in UTC.
+func Timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Line formats the event as a line of the plaintext protocol.
+func (e Event) Line() string {
+	switch e.Type {
+	case EVENT_LINK:
+		return ": " + e.URL
+	case EVENT_MESSAGE:
+		// messages from self start with " " and messages from someone
+		// else start with "+", followed by the message's position so
+		// they can be put in order
+		if e.Self {
+			return "  " + strconv.FormatUint(e.Seq, 10) + " " + e.URL
+		}
+		return "+ " + strconv.FormatUint(e.Seq, 10) + " " + e.URL
+	case EVENT_READ:
+		// read receipts say who read the message and when
+		return "- " + e.URL + " " + e.From + " " + e.Time
+	case EVENT_EXPIRED, EVENT_CANCELED:
+		// either way the message is gone
+		return "x " + e.URL
+	case EVENT_JOIN:
+		// joins and leaves say who and when, "> NAME TIME", and leaves also
+		// say why, "< NAME TIME REASON"
+		return "> " + e.From + " " + e.Time
+	case EVENT_LEAVE:
+		return "< " + e.From + " " + e.Time + " " + e.Text
+	case EVENT_PING:
+		return "."
+	case EVENT_NOTICE:
+		return "* " + e.Text
+	case EVENT_UNDELIVERED:
+		// a message didn't reach the other user, "? URL REASON"
+		return "? " + e.URL + " " + e.Text
+	case EVENT_ERROR:
+		// something went wrong that the user can do something about
+		return "! " + e.Text
+	case EVENT_TYPING:
+		return "~ " + e.From
+	}
+
+	return ""
+}
+
+// JSON formats the event as a JSON object.
+func (e Event) JSON() string {
+	// an Event only has strings, numbers and bools so this can't fail
+	data, _ := json.Marshal(e)
+	return string(data)
+}
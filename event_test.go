@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestEventLinePrefixes(t *testing.T) {
+	// every type of event a client has to tell apart, by the first two
+	// characters of its line
+	prefixes := map[string]string{}
+	for _, event := range []Event{
+		{Type: EVENT_LINK, URL: "u"},
+		{Type: EVENT_MESSAGE, Seq: 1, URL: "u"},
+		{Type: EVENT_MESSAGE, Seq: 1, URL: "u", Self: true},
+		{Type: EVENT_READ, URL: "u"},
+		{Type: EVENT_EXPIRED, URL: "u"},
+		{Type: EVENT_JOIN, From: "f"},
+		{Type: EVENT_LEAVE, From: "f"},
+		{Type: EVENT_PING},
+		{Type: EVENT_NOTICE, Text: "t"},
+		{Type: EVENT_TYPING, From: "f"},
+		{Type: EVENT_UNDELIVERED, URL: "u", Text: "t"},
+		{Type: EVENT_ERROR, Text: "t"},
+	} {
+		line := event.Line()
+		prefix := line[:min(len(line), 2)]
+		if other, ok := prefixes[prefix]; ok {
+			t.Errorf("%s and %s both start with %q", other, event.Type, prefix)
+		}
+		prefixes[prefix] = event.Type
+	}
+}
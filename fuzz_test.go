@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func FuzzRoute(f *testing.F) {
+	newTestServer(f)
+	convoId, err := Store.CreateConvo(userAt("10.0.0.1"), nil, 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add("GET", "/", "", "")
+	f.Add("GET", "/"+convoId, "text/event-stream", "")
+	f.Add("GET", "/"+convoId+"/status", "", "")
+	f.Add("GET", "/"+convoId+"/a/b", "", "")
+	f.Add("PUT", "/"+convoId, "true", "one\ntwo")
+	f.Add("PUT", "//", "", "hello")
+	f.Add("DELETE", "/"+convoId, "", "")
+	f.Add("HEAD", "/"+convoId, "", "")
+	f.Add("OPTIONS", "*", "", "")
+	f.Add("PATCH", "/", "", "")
+	f.Add("GET", "*", "", "")
+	f.Add("PUT", "", "", "")
+
+	f.Fuzz(func(t *testing.T, method, path, header, body string) {
+		// the streams would never end, so every request has already been
+		// hung up on
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := httptest.NewRequest("GET", "/", strings.NewReader(body))
+		r = r.WithContext(ctx)
+		r.Method = method
+		r.URL.Path = path
+		for _, name := range []string{
+			"Accept",
+			"Content-Type",
+			"Last-Event-ID",
+			"X-Forwarded-For",
+			TAG_HEADER,
+			BATCH_HEADER,
+			PING_INTERVAL_HEADER,
+			NICK_HEADER,
+		} {
+			r.Header.Set(name, header)
+		}
+
+		w := httptest.NewRecorder()
+		Route(w, r)
+
+		// a panic is recovered as a 500
+		if w.Code < 100 || w.Code > 599 ||
+			w.Code == http.StatusInternalServerError {
+			t.Fatalf("%s %q: got %d %q", method, path, w.Code, w.Body)
+		}
+	})
+}
+
+func FuzzGetIP(f *testing.F) {
+	f.Add("10.0.0.1:1234")
+	f.Add("[::1]:1234")
+	f.Add("[2001:DB8::1]:80")
+	f.Add("example.com:80")
+	f.Add("10.0.0.1")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, addr string) {
+		ip := GetIP(addr)
+
+		// anything that comes out is already in its canonical form
+		if NormalizeIP(ip) != ip {
+			t.Fatalf("GetIP(%q) = %q, which isn't normalized", addr, ip)
+		}
+		// and an IP comes out the same however it went in
+		if IsIP(ip) {
+			if again := GetIP(net.JoinHostPort(ip, "1")); again != ip {
+				t.Fatalf("GetIP(%q) = %q, then %q", addr, ip, again)
+			}
+		}
+	})
+}
+
+func FuzzNewId(f *testing.F) {
+	f.Add([]byte(nil), 8, ID_ALPHABET)
+	f.Add([]byte("salt"), 1, "ab")
+	f.Add([]byte{}, 64, "0123456789")
+
+	f.Fuzz(func(t *testing.T, data []byte, length int, alphabet string) {
+		if length < 1 || length > 64 || CheckIdAlphabet(alphabet) != nil {
+			t.Skip()
+		}
+		setGlobal(t, &IdLength, length)
+		setGlobal(t, &IdAlphabet, alphabet)
+
+		id, err := NewId(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != length {
+			t.Fatalf("id %q has length %d, want %d", id, len(id), length)
+		}
+		for _, char := range id {
+			if !strings.ContainsRune(alphabet, char) {
+				t.Fatalf("id %q has %q, which isn't in %q", id, char, alphabet)
+			}
+		}
+	})
+}
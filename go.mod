@@ -0,0 +1,3 @@
+module github.com/karlmcguire/convo.space
+
+go 1.24
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// STREAM_TIMEOUT is how long a test waits for the next line of a stream
+// before it fails.
+const STREAM_TIMEOUT = time.Second * 5
+
+// TestMain keeps the request logs out of the test output.
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// setGlobal sets one of the globals the flags normally set for the rest of a
+// test, and puts it back once the test is done.
+func setGlobal[T any](t testing.TB, global *T, value T) {
+	t.Helper()
+
+	old := *global
+	*global = value
+	t.Cleanup(func() { *global = old })
+}
+
+// testServer serves Handler() over TLS with a room of its own, so tests don't
+// see each other's conversations.
+type testServer struct {
+	*httptest.Server
+	// base is the BasePath the server was started with, which the clients
+	// put in front of every path
+	base string
+}
+
+// newTestServer starts a server for the test, and stops it once the test is
+// done. Globals that change which routes exist (like AdminToken or BasePath)
+// have to be set before calling it.
+func newTestServer(t testing.TB) *testServer {
+	t.Helper()
+
+	setGlobal(t, &Store, NewRoom(RealClock{}))
+	setGlobal(t, &PutLimiter, NewLimiter(DEFAULT_RATE, DEFAULT_BURST))
+	setGlobal(t, &TypingLimiter, NewLimiter(TYPING_RATE, TYPING_BURST))
+	setGlobal(
+		t,
+		&ReadLimiter,
+		NewLimiter(DEFAULT_READ_RATE, DEFAULT_READ_BURST),
+	)
+	setGlobal(
+		t,
+		&JoinLimiter,
+		NewLimiter(DEFAULT_JOIN_RATE, DEFAULT_JOIN_BURST),
+	)
+	setGlobal(t, &Creating, NewSemaphore(DEFAULT_MAX_CONCURRENT_CREATES))
+	// every client connects from 127.0.0.1, so each one says which IP it
+	// is with X-Forwarded-For
+	setGlobal(t, &TrustProxy, true)
+
+	server := httptest.NewTLSServer(Handler())
+	setGlobal(t, &URL, server.URL+BasePath+"/")
+
+	t.Cleanup(func() {
+		// end the streams first, the server waits for every request
+		Store.Close()
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	return &testServer{Server: server, base: BasePath}
+}
+
+// testClient makes requests to a testServer from an IP of its own.
+type testClient struct {
+	t      *testing.T
+	server *testServer
+	ip     string
+}
+
+// client returns a client that connects from ip.
+func (s *testServer) client(t *testing.T, ip string) *testClient {
+	return &testClient{t: t, server: s, ip: ip}
+}
+
+// do makes a request with body and the headers in header, which alternate
+// between name and value. The server's BasePath goes in front of path.
+func (c *testClient) do(
+	method, path, body string,
+	header ...string,
+) *http.Response {
+	c.t.Helper()
+
+	r, err := http.NewRequest(
+		method,
+		c.server.URL+c.server.base+path,
+		strings.NewReader(body),
+	)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.Header.Set("X-Forwarded-For", c.ip)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := c.server.Client().Do(r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return resp
+}
+
+// text makes a request and returns its status and body.
+func (c *testClient) text(
+	method, path, body string,
+	header ...string,
+) (int, string) {
+	c.t.Helper()
+
+	resp := c.do(method, path, body, header...)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(data)
+}
+
+// testStream reads the lines of an event stream as they arrive.
+type testStream struct {
+	t     *testing.T
+	resp  *http.Response
+	lines chan string
+}
+
+// stream opens the event stream at path, failing the test if it doesn't get
+// a 200.
+func (c *testClient) stream(path string, header ...string) *testStream {
+	c.t.Helper()
+
+	resp := c.do("GET", path, "", header...)
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.t.Fatalf("GET %s: %d %s", path, resp.StatusCode, data)
+	}
+
+	stream := &testStream{
+		t:     c.t,
+		resp:  resp,
+		lines: make(chan string, 64),
+	}
+	go func() {
+		defer close(stream.lines)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// the comments and the retry hint aren't part of the
+			// protocol
+			if line == "" || line == ":" ||
+				strings.HasPrefix(line, "retry: ") {
+				continue
+			}
+			stream.lines <- line
+		}
+	}()
+	c.t.Cleanup(stream.close)
+
+	return stream
+}
+
+// next returns the next line of the stream.
+func (s *testStream) next() string {
+	s.t.Helper()
+
+	select {
+	case line, ok := <-s.lines:
+		if !ok {
+			s.t.Fatal("stream ended")
+		}
+		return line
+	case <-time.After(STREAM_TIMEOUT):
+		s.t.Fatal("timed out waiting for the stream")
+	}
+
+	return ""
+}
+
+// expect returns the next line of the stream, failing the test if it doesn't
+// start with prefix.
+func (s *testStream) expect(prefix string) string {
+	s.t.Helper()
+
+	line := s.next()
+	if !strings.HasPrefix(line, prefix) {
+		s.t.Fatalf("got %q, want a line starting with %q", line, prefix)
+	}
+
+	return line
+}
+
+// ended waits for the stream to end, failing the test if another line comes
+// first.
+func (s *testStream) ended() {
+	s.t.Helper()
+
+	select {
+	case line, ok := <-s.lines:
+		if ok {
+			s.t.Fatalf("got %q, want the stream to end", line)
+		}
+	case <-time.After(STREAM_TIMEOUT):
+		s.t.Fatal("timed out waiting for the stream to end")
+	}
+}
+
+// close hangs up the stream.
+func (s *testStream) close() {
+	s.resp.Body.Close()
+}
+
+// create creates a conversation and returns the creator's stream and the
+// conversation's id.
+func (c *testClient) create(header ...string) (*testStream, string) {
+	c.t.Helper()
+
+	stream := c.stream("/", header...)
+	convoId := strings.TrimPrefix(stream.expect(": "+URL), ": "+URL)
+	stream.expect("* waiting for someone to join")
+
+	return stream, convoId
+}
+
+// join joins the conversation with convoId and returns the stream.
+func (c *testClient) join(convoId string, header ...string) *testStream {
+	c.t.Helper()
+
+	return c.stream("/"+convoId, header...)
+}
+
+// put sends a message to the conversation with convoId and returns its URL.
+func (c *testClient) put(convoId, message string, header ...string) string {
+	c.t.Helper()
+
+	status, body := c.text("PUT", "/"+convoId, message, header...)
+	if status != http.StatusCreated {
+		c.t.Fatalf("PUT /%s: %d %s", convoId, status, body)
+	}
+
+	fields := strings.Fields(body)
+	if len(fields) != 2 {
+		c.t.Fatalf("PUT /%s: unexpected body %q", convoId, body)
+	}
+
+	return fields[1]
+}
+
+// read reads the message at url and returns it.
+func (c *testClient) read(url string) string {
+	c.t.Helper()
+
+	status, body := c.text("GET", "/"+strings.TrimPrefix(url, URL), "")
+	if status != http.StatusOK {
+		c.t.Fatalf("GET %s: %d %s", url, status, body)
+	}
+
+	return body
+}
+
+// testConvo is a conversation between two clients, both connected.
+type testConvo struct {
+	id          string
+	alice, bob  *testClient
+	aliceStream *testStream
+	bobStream   *testStream
+}
+
+// convo creates a conversation from 10.0.0.1 that 10.0.0.2 joins, and waits
+// for both to hear about each other.
+func (s *testServer) convo(t *testing.T) *testConvo {
+	t.Helper()
+
+	convo := &testConvo{
+		alice: s.client(t, "10.0.0.1"),
+		bob:   s.client(t, "10.0.0.2"),
+	}
+	convo.aliceStream, convo.id = convo.alice.create()
+	convo.bobStream = convo.bob.join(convo.id)
+	convo.aliceStream.expect("> 10.0.0.2 ")
+	convo.bobStream.expect("> 10.0.0.1 ")
+
+	return convo
+}
+
+// messageCount returns how many messages the conversation with convoId holds.
+func messageCount(t *testing.T, convoId string) int {
+	t.Helper()
+
+	Store.Lock()
+	defer Store.Unlock()
+
+	convo, ok := Store.Convos[convoId]
+	if !ok {
+		t.Fatalf("conversation %s doesn't exist", convoId)
+	}
+
+	return len(convo.Messages)
+}
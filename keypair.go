@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keypair holds the certificate the server hands out, loaded from the -cert
+// and -key files, so it can be swapped for a renewed one without restarting.
+type Keypair struct {
+	sync.RWMutex
+	// CertPath and KeyPath are the files the certificate is loaded from
+	CertPath string
+	KeyPath  string
+	// Certificate is the certificate currently being served
+	Certificate *tls.Certificate
+	// modified is when each file was last changed at the last load, so Watch
+	// can tell when they've been rotated
+	modified [2]time.Time
+}
+
+// Keys is the global certificate and key.
+var Keys = &Keypair{}
+
+// Load reads the certificate and key from their files, replacing the ones
+// already loaded. If they can't be read, or don't go together, nothing is
+// replaced and the old certificate keeps being served.
+func (k *Keypair) Load() error {
+	modified, err := k.Modified()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(k.CertPath, k.KeyPath)
+	if err != nil {
+		return err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	k.Certificate, k.modified = &certificate, modified
+
+	return nil
+}
+
+// Modified returns when the certificate and key files were last changed.
+func (k *Keypair) Modified() ([2]time.Time, error) {
+	var modified [2]time.Time
+
+	for i, path := range []string{k.CertPath, k.KeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+
+	return modified, nil
+}
+
+// GetCertificate returns the certificate currently being served, for
+// tls.Config.
+func (k *Keypair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.Certificate, nil
+}
+
+// Watch checks the files every interval and loads them again when either one
+// has changed. Connections that are already open keep going, only new ones
+// get the new certificate.
+func (k *Keypair) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modified, err := k.Modified()
+		if err != nil {
+			slog.Warn("couldn't check certificate", "err", err)
+			continue
+		}
+
+		k.RLock()
+		changed := modified != k.modified
+		k.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// certbot writes the files one after the other, so a failed load
+		// is usually fixed by the next check
+		if err = k.Load(); err != nil {
+			slog.Warn("couldn't reload certificate", "err", err)
+			continue
+		}
+		slog.Info(
+			"reloaded certificate",
+			"cert", k.CertPath,
+			"key", k.KeyPath,
+		)
+	}
+}
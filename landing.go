@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+const (
+	// LANDING_CACHE_CONTROL is how long the landing page can be cached for
+	LANDING_CACHE_CONTROL = "public, max-age=300"
+)
+
+var (
+	// LandingPath is the HTML file served as the landing page instead of
+	// PAGE, empty to use PAGE
+	LandingPath string
+	// LandingReload is whether or not the landing page is read again on
+	// every request, so it can be edited without restarting
+	LandingReload bool
+	// LandingStatus is the status the landing page is served with, something
+	// like 503 to serve a maintenance page
+	LandingStatus int = http.StatusOK
+	// landing is the landing page read at startup
+	landing []byte = []byte(PAGE)
+)
+
+// LoadLandingPage reads the landing page from LandingPath. If there isn't one,
+// or it can't be read, the embedded PAGE is used instead.
+func LoadLandingPage() []byte {
+	if LandingPath == "" {
+		return []byte(PAGE)
+	}
+
+	data, err := os.ReadFile(LandingPath)
+	if err != nil {
+		slog.Warn(
+			"couldn't read landing page, using the default",
+			"file", LandingPath,
+			"err", err,
+		)
+		return []byte(PAGE)
+	}
+
+	return data
+}
+
+// LandingPage returns the landing page to serve.
+func LandingPage() []byte {
+	if LandingReload {
+		return LoadLandingPage()
+	}
+
+	return landing
+}
+
+// LandingCacheControl returns the Cache-Control header for the landing page.
+// A page that's being edited or isn't a 200 shouldn't be cached, so it's gone
+// as soon as the server is out of maintenance.
+func LandingCacheControl() string {
+	if LandingReload || LandingStatus != http.StatusOK {
+		return "no-store"
+	}
+
+	return LANDING_CACHE_CONTROL
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// LIMITER_SWEEP is how often a Limiter deletes the buckets that have filled
+// back up.
+const LIMITER_SWEEP = time.Minute
+
+// ErrRateLimited is returned when an IP is making requests too fast.
+var ErrRateLimited = errors.New("too many requests, slow down")
+
+// Limiter is a token bucket rate limiter keyed by IP.
+type Limiter struct {
+	sync.Mutex
+	// Rate is how many tokens are added to each bucket per second, zero
+	// means there's no limit
+	Rate float64
+	// Burst is the most tokens a bucket can hold
+	Burst int
+	// Buckets is a map of each limited IP to its bucket
+	Buckets map[string]*Bucket
+	// Swept is when the full buckets were last deleted
+	Swept time.Time
+}
+
+// Bucket holds the tokens left for a single IP.
+type Bucket struct {
+	// Tokens is how many requests can be made right now
+	Tokens float64
+	// Last is when Tokens was last brought up to date
+	Last time.Time
+}
+
+// NewLimiter creates a new Limiter allowing rate requests per second with
+// bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		Rate:    rate,
+		Burst:   burst,
+		Buckets: make(map[string]*Bucket, 0),
+	}
+}
+
+// Allow takes a token from the ip's bucket, it returns false if the bucket
+// is empty and the request should be rejected.
+func (l *Limiter) Allow(ip string) bool {
+	return l.AllowN(ip, 1)
+}
+
+// AllowN takes n tokens from the ip's bucket, for a request that counts as n
+// requests. It returns false without taking any if there aren't enough.
+func (l *Limiter) AllowN(ip string, n int) bool {
+	if l.Rate <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	var (
+		now    = time.Now()
+		bucket *Bucket
+		ok     bool
+	)
+
+	// IPs that fail every check still get a bucket, so the ones that
+	// aren't needed anymore are deleted every so often
+	if now.Sub(l.Swept) >= LIMITER_SWEEP {
+		l.sweep(now)
+	}
+
+	// new IPs start with a full bucket
+	if bucket, ok = l.Buckets[ip]; !ok {
+		bucket = &Bucket{Tokens: float64(l.Burst), Last: now}
+		l.Buckets[ip] = bucket
+	}
+	l.fill(bucket, now)
+
+	if bucket.Tokens < float64(n) {
+		return false
+	}
+
+	bucket.Tokens -= float64(n)
+	return true
+}
+
+// fill adds the tokens bucket earned since it was last brought up to date,
+// without going over the burst size. The caller must hold the lock.
+func (l *Limiter) fill(bucket *Bucket, now time.Time) {
+	bucket.Tokens += now.Sub(bucket.Last).Seconds() * l.Rate
+	if bucket.Tokens > float64(l.Burst) {
+		bucket.Tokens = float64(l.Burst)
+	}
+	bucket.Last = now
+}
+
+// sweep deletes every bucket that has filled back up, which is the same as the
+// IP not having one since new IPs start with a full bucket. A bucket that
+// hasn't been touched for Burst/Rate seconds is always full. The caller must
+// hold the lock.
+func (l *Limiter) sweep(now time.Time) {
+	for ip, bucket := range l.Buckets {
+		if l.fill(bucket, now); bucket.Tokens >= float64(l.Burst) {
+			delete(l.Buckets, ip)
+		}
+	}
+	l.Swept = now
+}
+
+// Forget deletes the ip's bucket, so the map doesn't keep growing with IPs
+// that are gone.
+func (l *Limiter) Forget(ip string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.Buckets, ip)
+}
+
+// ErrBusy is returned when too much is already going on to start something
+// new.
+var ErrBusy = errors.New("server is busy, try again later")
+
+// Semaphore limits how many of something can happen at once, a nil Semaphore
+// has no limit.
+type Semaphore chan struct{}
+
+// NewSemaphore creates a new Semaphore allowing n at once, zero means no
+// limit.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(Semaphore, n)
+}
+
+// Acquire takes a slot without waiting, it returns false if they're all taken
+// and the caller should give up.
+func (s Semaphore) Acquire() bool {
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release gives back a slot taken by Acquire.
+func (s Semaphore) Release() {
+	if s == nil {
+		return
+	}
+
+	<-s
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLimiterSweep(t *testing.T) {
+	// a token every 40 seconds, so in a minute a bucket that had one left
+	// fills back up, and an empty one doesn't
+	limiter := NewLimiter(0.025, 2)
+
+	// lots of IPs that each tried once and never came back
+	for i := 0; i < 100; i++ {
+		limiter.Allow(fmt.Sprintf("10.0.0.%d", i))
+	}
+	// and one that's still out of tokens
+	limiter.AllowN("10.0.1.1", 2)
+
+	// make it look like every request was a sweep ago
+	limiter.Lock()
+	past := time.Now().Add(-LIMITER_SWEEP)
+	for _, bucket := range limiter.Buckets {
+		bucket.Last = past
+	}
+	limiter.Swept = past
+	limiter.Unlock()
+
+	if !limiter.Allow("10.0.2.1") {
+		t.Fatal("a new IP was rate limited")
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+	if len(limiter.Buckets) != 2 {
+		t.Fatalf("%d buckets are left, want 2", len(limiter.Buckets))
+	}
+	if _, ok := limiter.Buckets["10.0.1.1"]; !ok {
+		t.Fatal("the bucket that isn't full yet was deleted")
+	}
+}
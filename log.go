@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// REQUEST_ID_HEADER is the response header with the request's correlation id.
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// requestIdKey is the context key the request's correlation id is stored
+// under.
+type requestIdKey struct{}
+
+// ContextHandler is a slog.Handler that adds the request's correlation id to
+// every line logged with a request's context.
+type ContextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the correlation id, if the context has one, and passes the
+// record on to the wrapped handler.
+func (h ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId, ok := ctx.Value(requestIdKey{}).(string); ok {
+		record.AddAttrs(slog.String("requestId", requestId))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps the wrapper around handlers made with extra attributes.
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the wrapper around handlers made with a group.
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{h.Handler.WithGroup(name)}
+}
+
+// StatusWriter remembers the status written to a ResponseWriter, so it can be
+// logged once the request is done.
+type StatusWriter struct {
+	http.ResponseWriter
+	// Status is the status written, 200 if WriteHeader was never called
+	Status int
+}
+
+// WriteHeader remembers the status before writing it.
+func (w *StatusWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush flushes the wrapped ResponseWriter, the event streams can't work
+// without it.
+func (w *StatusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can
+// reach it to set deadlines.
+func (w *StatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LogRequests wraps handler so each request gets a correlation id, returned in
+// the X-Request-ID header and added to everything logged with the request's
+// context, and is logged once it's done.
+func LogRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start  = time.Now()
+			status = &StatusWriter{ResponseWriter: w, Status: http.StatusOK}
+		)
+
+		// a request without an id is still worth serving
+		if requestId, err := NewId(nil); err == nil {
+			w.Header().Set(REQUEST_ID_HEADER, requestId)
+			r = r.WithContext(context.WithValue(
+				r.Context(),
+				requestIdKey{},
+				requestId,
+			))
+		}
+
+		handler.ServeHTTP(status, r)
+
+		slog.InfoContext(
+			r.Context(),
+			"request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"ip", RequestIP(r),
+			"status", status.Status,
+			"duration", time.Since(start),
+		)
+	})
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -14,24 +26,150 @@ const (
 	DEFAULT_DOMAIN = "localhost"
 	DEFAULT_PORT   = 8080
 
+	// how often each conversation is pinged to keep connections open
+	DEFAULT_PING_INTERVAL = time.Second * 30
+	// how often a comment is written to each stream to keep it open, zero
+	// means never
+	DEFAULT_KEEPALIVE = time.Second * 15
+	// how long EventSource clients wait before reconnecting, zero leaves it up
+	// to the client
+	DEFAULT_RETRY = time.Second * 3
+	// how long a write to a user can take before they're disconnected, zero
+	// means forever
+	DEFAULT_WRITE_TIMEOUT = time.Second * 10
+	// how long a user can stay connected, zero means forever
+	DEFAULT_MAX_CONNECTION_DURATION = 0
+	// how long a conversation waits for the last user to reconnect before
+	// it's deleted, zero means it's deleted right away
+	DEFAULT_RECONNECT_GRACE = 0
+	// how long a conversation restored from the state file waits for its
+	// users to come back before it's deleted
+	DEFAULT_RESTORE_GRACE = time.Minute * 10
+	// how long a message can go unread before it's deleted
+	DEFAULT_MESSAGE_TTL = time.Minute * 5
+
+	// how long a conversation can go without messages before it ends, zero
+	// means forever
+	DEFAULT_IDLE_TIMEOUT = 0
+	// how long a new conversation waits for someone to join before it ends,
+	// zero means forever
+	DEFAULT_JOIN_TIMEOUT = 0
+
+	// how many messages each IP can send per second, and in a single burst
+	DEFAULT_RATE  = 1
+	DEFAULT_BURST = 10
+
+	// how many typing notifications each IP can send per second, and in a
+	// single burst, clients only need to send one every few seconds
+	TYPING_RATE  = 0.5
+	TYPING_BURST = 2
+
+	// how many messages each IP can read per second, and in a single burst,
+	// reading someone else's message tells them it was read
+	DEFAULT_READ_RATE  = 5
+	DEFAULT_READ_BURST = 20
+
+	// how many password guesses each IP can make per second, and in a
+	// single burst, each one is hashed and hashing is slow on purpose
+	DEFAULT_JOIN_RATE  = 0.2
+	DEFAULT_JOIN_BURST = 5
+
+	// how many conversations can exist at once, and how many each IP can be
+	// in at once, zero means no limit
+	DEFAULT_MAX_CONVOS        = 10000
+	DEFAULT_MAX_CONVOS_PER_IP = 10
+	// how many conversations can be in the middle of being created at once,
+	// hashing passwords is slow so a burst of them has to wait its turn, zero
+	// means no limit
+	DEFAULT_MAX_CONCURRENT_CREATES = 64
+
+	// how many events can wait for a user before new ones are dropped, enough
+	// to hold a full replay of the event backlog
+	DEFAULT_PIPE_DEPTH = 128
+	// the smallest pipe that holds a full replay of the event backlog along
+	// with the events a user is welcomed with, so rejoining never drops any
+	MIN_PIPE_DEPTH = EVENT_BACKLOG + 2
+
+	// how many unread messages a conversation can hold, and how many bytes
+	// they can add up to, zero means no limit
+	DEFAULT_MAX_CONVO_MESSAGES = 100
+	DEFAULT_MAX_CONVO_BYTES    = 1024 * 1024
+	// how many bytes the messages of every conversation can add up to, zero
+	// means no limit
+	DEFAULT_MAX_TOTAL_BYTES = 0
+
+	// how many users can wait for a slot in a full conversation
+	QUEUE_LENGTH = 10
+
+	// the largest message that can be sent, in bytes
+	DEFAULT_MAX_MESSAGE_BYTES = 64 * 1024
+	// the longest part of a path that's looked at, ids are much shorter so
+	// anything longer can't be one
+	DEFAULT_MAX_SEGMENT_LENGTH = 64
+
+	// which origins browsers can make requests from
+	DEFAULT_CORS_ORIGIN = "*"
+
+	// the least important log lines that are written
+	DEFAULT_LOG_LEVEL = "info"
+
+	// the oldest and newest TLS versions the server negotiates
+	DEFAULT_TLS_MIN = "1.2"
+	DEFAULT_TLS_MAX = "1.3"
+
 	// filepath locations of the needed SSL files
 	DEFAULT_CERT_LOCATION = "../ssl/cert.pem"
 	DEFAULT_KEY_LOCATION  = "../ssl/key.pem"
+	// how often the SSL files are checked for a renewed certificate, zero
+	// means never
+	DEFAULT_CERT_RELOAD_INTERVAL = time.Minute
+
+	// the port of the plain HTTP listener that redirects to HTTPS
+	HTTP_REDIRECT_PORT = 80
 
-	// only used if localhost
+	// how long the server waits for streams to end when it's shutting down
+	SHUTDOWN_TIMEOUT = time.Second * 5
+
+	// the port browsers and curl use for https when none is given
+	HTTPS_PORT = 443
+
+	// used when the port isn't the https default
 	URL_PORT_FORMAT = "https://%s:%d/"
 
-	// used for real domains
+	// used when the port is the https default
 	URL_FORMAT = "https://%s/"
+
+	// the methods Route handles, anything else gets a 405
+	ALLOWED_METHODS = "GET, PUT, DELETE, HEAD, OPTIONS"
 )
 
+// RouteNames are the parts of a path that name a route instead of being an id,
+// they're matched in any case.
+var RouteNames = map[string]bool{
+	"list":    true,
+	"status":  true,
+	"link":    true,
+	"debug":   true,
+	"kick":    true,
+	"history": true,
+	"typing":  true,
+}
+
 var (
 	// Store is the global store of all the conversations.
-	Store *Room = &Room{Convos: make(map[string]*Convo, 0)}
+	Store *Room = NewRoom(RealClock{})
+	// TLS_VERSIONS are the TLS versions that can be passed to -tls-min and
+	// -tls-max, anything older isn't safe to use
+	TLS_VERSIONS = map[string]uint16{
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
 	// SSL config stuff
+	//
+	// the cipher suites only apply to TLS 1.2, TLS 1.3 picks its own
 	TLSCONFIG = &tls.Config{
 		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
 		CurvePreferences: []tls.CurveID{
 			tls.CurveP521,
 			tls.CurveP384,
@@ -46,45 +184,197 @@ var (
 		},
 	}
 
-	// URL is the final https://DOMAIN:PORT/ string to be sent in messages
+	// URL is the final https://DOMAIN:PORT/ string to be sent in messages,
+	// with the BasePath on the end if there is one
 	URL string
+	// BasePath is the path the server is served under behind a reverse
+	// proxy, like "/convo", empty if it's served at the root
+	BasePath string
+	// PingInterval is how often each conversation pings its users
+	PingInterval time.Duration = DEFAULT_PING_INTERVAL
+	// PingDots is whether or not pings are written to plaintext users as a
+	// visible ".", JSON users always get them
+	PingDots bool = true
+	// Keepalive is how often a comment is written to each stream to keep it
+	// open, zero means never
+	Keepalive time.Duration = DEFAULT_KEEPALIVE
+	// SSEEvents is whether or not EventSource clients get each event framed
+	// with an event: field for its type and a data: field
+	SSEEvents bool
+	// Retry is how long EventSource clients wait before reconnecting, zero
+	// leaves it up to the client
+	Retry time.Duration = DEFAULT_RETRY
+	// WriteTimeout is how long a write to a user can take before they're
+	// disconnected, zero means forever
+	WriteTimeout time.Duration = DEFAULT_WRITE_TIMEOUT
+	// MaxConnectionDuration is how long a user can stay connected, zero means
+	// forever
+	MaxConnectionDuration time.Duration = DEFAULT_MAX_CONNECTION_DURATION
+	// ReconnectGrace is how long a conversation waits for the last user to
+	// reconnect before it's deleted, zero means it's deleted right away
+	ReconnectGrace time.Duration = DEFAULT_RECONNECT_GRACE
+	// RestoreGrace is how long a conversation restored from the state file
+	// waits for its users to come back before it's deleted
+	RestoreGrace time.Duration = DEFAULT_RESTORE_GRACE
+	// MessageTTL is how long a message can go unread, zero means forever
+	MessageTTL time.Duration = DEFAULT_MESSAGE_TTL
+	// IdleTimeout is how long a conversation can go without a message being
+	// added or read before it ends, zero means forever
+	IdleTimeout time.Duration = DEFAULT_IDLE_TIMEOUT
+	// JoinTimeout is how long a new conversation waits for someone to join
+	// before it ends, zero means forever
+	JoinTimeout time.Duration = DEFAULT_JOIN_TIMEOUT
+	// PutLimiter limits how often each IP can send messages
+	PutLimiter *Limiter = NewLimiter(DEFAULT_RATE, DEFAULT_BURST)
+	// TypingLimiter limits how often each IP can say they're typing
+	TypingLimiter *Limiter = NewLimiter(TYPING_RATE, TYPING_BURST)
+	// ReadLimiter limits how often each IP can read messages
+	ReadLimiter *Limiter = NewLimiter(DEFAULT_READ_RATE, DEFAULT_READ_BURST)
+	// JoinLimiter limits how often each IP can guess the password of a
+	// conversation
+	JoinLimiter *Limiter = NewLimiter(DEFAULT_JOIN_RATE, DEFAULT_JOIN_BURST)
+	// MaxConvos is how many conversations can exist at once, zero means no
+	// limit
+	MaxConvos int = DEFAULT_MAX_CONVOS
+	// MaxConvosPerIP is how many conversations each IP can be in at once when
+	// creating a new one, zero means no limit
+	MaxConvosPerIP int = DEFAULT_MAX_CONVOS_PER_IP
+	// Creating limits how many conversations can be in the middle of being
+	// created at once
+	Creating Semaphore = NewSemaphore(DEFAULT_MAX_CONCURRENT_CREATES)
+	// PipeDepth is how many events can wait for a user before new ones are
+	// dropped
+	PipeDepth int = DEFAULT_PIPE_DEPTH
+	// MaxConvoMessages is how many messages a conversation can hold, zero
+	// means no limit. Only unread ones are turned away for it, read ones in
+	// the history are evicted oldest first to make room
+	MaxConvoMessages int = DEFAULT_MAX_CONVO_MESSAGES
+	// MaxConvoBytes is how many bytes the messages of a conversation can add
+	// up to, zero means no limit, with the history evicted the same way
+	MaxConvoBytes int64 = DEFAULT_MAX_CONVO_BYTES
+	// MaxTotalBytes is how many bytes the messages held by every conversation
+	// can add up to, read ones in the history included, zero means no limit
+	MaxTotalBytes int64 = DEFAULT_MAX_TOTAL_BYTES
+	// MaxMessageBytes is the largest message that can be sent, in bytes
+	MaxMessageBytes int64 = DEFAULT_MAX_MESSAGE_BYTES
+	// MaxSegmentLength is the longest part of a path that's looked at
+	MaxSegmentLength int = DEFAULT_MAX_SEGMENT_LENGTH
+	// CORSOrigin is the origin browsers can make requests from
+	CORSOrigin string = DEFAULT_CORS_ORIGIN
+	// PublicStatus is whether or not anyone with the link can see how many
+	// users are in a conversation, instead of just the participants
+	PublicStatus bool
+	// LogSummaries is whether or not a summary of each conversation is logged
+	// when it ends
+	LogSummaries bool
+	// KeepHistory is whether or not read messages are kept, so they can be
+	// read again from the history
+	KeepHistory bool
+	// AllowQueue is whether or not users joining a full conversation wait for
+	// a slot instead of being turned away
+	AllowQueue bool
+	// AllowSameIP is whether or not both slots of a conversation can be taken
+	// from the same IP, for testing on one machine
+	AllowSameIP bool
+	// StartTime is when the server started, for reporting uptime
+	StartTime time.Time = time.Now()
+	// AdminToken is the bearer token for the admin routes, they're disabled
+	// if it's empty
+	AdminToken string
+)
+
+var (
+	// ErrNoRoute is returned when a request's path doesn't match any route.
+	ErrNoRoute = errors.New("no such route")
+	// ErrLongPath is returned when part of a request's path is longer than
+	// MaxSegmentLength.
+	ErrLongPath = errors.New("path is too long")
 )
 
 // GET is called when someone makes a GET request to the server. This function
-// first determines whether or not it is coming from curl, and then determines
-// the user's intention based on URL variables.
+// first determines whether or not it is coming from a browser, and then
+// determines the user's intention based on URL variables.
 func GET(w http.ResponseWriter, r *http.Request, ids []string) {
-	// if the request isn't coming from CURL then we want to display the
+	// if the request is coming from a browser then we want to display the
 	// landing page
 	//
-	// if the request is coming from curl then we want to check the URL
-	// variables and handle accordingly
-	if len(r.Header.Get("User-Agent")) < 4 ||
-		r.Header.Get("User-Agent")[:4] != "curl" {
-		// write the landing page
-		w.Write([]byte(PAGE))
+	// anything else (curl, wget, HTTPie, EventSource) is a CLI client, so we
+	// want to check the URL variables and handle accordingly
+	if IsBrowser(r) {
+		Landing(w, r)
 		return
 	}
 
 	if len(ids) == 2 {
 		if len(ids[1]) == 0 { // https://DOMAIN/
 			var (
-				user    *User = NewUser(w, r)
-				convoId string
-				err     error
+				user     *User = NewUser(w, r)
+				convoId  string
+				password *Password
+				interval time.Duration
+				err      error
 			)
 
+			if err = CheckNick(user.Nick); err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			// the creator can choose how often the conversation is pinged,
+			// for connections that need it more or less often
+			if interval, err = ParsePingInterval(
+				r.Header.Get(PING_INTERVAL_HEADER),
+			); err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			// only so many conversations can be created at once, so a
+			// flood of creates is turned away instead of piling up. The
+			// slot is only held until the conversation exists, not while
+			// the user listens
+			if !Creating.Acquire() {
+				Error(w, r, ErrBusy)
+				return
+			}
+
+			// the creator can give the conversation a password, which
+			// everyone joining it needs
+			if r.Header.Get(PASSWORD_HEADER) != "" {
+				if password, err = NewPassword(
+					r.Header.Get(PASSWORD_HEADER),
+				); err != nil {
+					Creating.Release()
+					Error(w, r, err)
+					return
+				}
+			}
+
 			// attempt to create a new conversation and store the convoId
-			if convoId, err = Store.CreateConvo(user); err != nil {
-				panic(err)
+			convoId, err = Store.CreateConvo(user, password, interval)
+			Creating.Release()
+			if err != nil {
+				Error(w, r, err)
+				return
 			}
 
-			// write the new link to the initial user
-			go user.Write([]byte(": " + URL + convoId))
+			// write the new link to the initial user, and let them know
+			// they're waiting so the link isn't followed by silence
+			user.Write(Event{Type: EVENT_LINK, URL: URL + convoId})
+			user.Write(Event{
+				Type: EVENT_NOTICE,
+				Text: "waiting for someone to join",
+			})
 
 			// start the listening
 			if err = user.Listen(); err != nil {
-				panic(err)
+				Error(w, r, err)
+			}
+		} else if ids[1] == "list" { // https://DOMAIN/list
+			// write a link to each conversation the client is in, so a lost
+			// link can be found again
+			for _, convoId := range Store.ConvosForIP(RequestIP(r)) {
+				fmt.Fprintf(w, "%s%s\n", URL, convoId)
 			}
 		} else { // https://DOMAIN/convoId
 			// the client is trying to join a conversation with convoId
@@ -94,56 +384,253 @@ func GET(w http.ResponseWriter, r *http.Request, ids []string) {
 				err     error
 			)
 
-			// check if the conversation exists and whether it's full
-			if !Store.IsConvo(convoId) || Store.IsConvoFull(convoId) {
+			if err = CheckNick(user.Nick); err != nil {
+				Error(w, r, err)
 				return
 			}
 
-			// attempt to add the new user to the conversation
-			if err = Store.JoinConvo(user, convoId); err != nil {
-				panic(err)
+			// check if the conversation exists and whether it's full, a
+			// full conversation is fine if the user can wait for a slot
+			if !Store.IsConvo(convoId) {
+				Error(w, r, ErrConvoGone)
+				return
+			}
+			if !AllowQueue && Store.IsConvoFull(convoId) {
+				Error(w, r, ErrConvoFull)
+				return
+			}
+
+			// checking the password is slow, so it's done without holding
+			// the room lock, and each IP only gets so many tries before
+			// anything is hashed
+			password := Store.Password(convoId)
+			if password != nil && !JoinLimiter.Allow(user.IP) {
+				Error(w, r, ErrRateLimited)
+				return
+			}
+			if !password.Check(r.Header.Get(PASSWORD_HEADER)) {
+				Error(w, r, ErrWrongPassword)
+				return
 			}
 
-			// since user.Listen() will run infinitely, we need to add a
-			// notification message to the user's message queue before calling
-			// user.Listen(), because user.Write will block until something
-			// can read from the channel
-			//
-			// this small goroutine will fire once
-			go user.Write(Store.OtherUser(convoId, user.UserId))
+			// attempt to add the new user to the conversation, it might have
+			// been deleted or filled up since the checks above
+			if _, err = Store.JoinConvo(user, convoId); err != nil {
+				Error(w, r, err)
+				return
+			}
 
-			// start the listening
+			// start the listening, JoinConvo has already queued who's on
+			// the other side and what the user missed, or that they're
+			// waiting for a slot
 			if err = user.Listen(); err != nil {
-				panic(err)
+				Error(w, r, err)
 			}
+		}
+	} else if len(ids) == 3 && ids[2] == "status" {
+		// https://DOMAIN/convoId/status
+		var convoId string = ids[1]
 
-			// the user.Write above will fire here
+		// check if the conversation actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// unless the status is public, only participants can see it
+		if !PublicStatus && !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		users := Store.ConvoUserCount(convoId)
+		fmt.Fprintf(w, "users %d\nfull %t\n", users, users == 2)
+	} else if len(ids) == 3 && ids[2] == "link" {
+		// https://DOMAIN/convoId/link
+		var convoId string = ids[1]
+
+		// check if the conversation actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// the link is how people get in, so only participants get it again
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		fmt.Fprintf(w, "%s%s\n", URL, convoId)
+	} else if len(ids) == 3 && ids[2] == "debug" {
+		// https://DOMAIN/convoId/debug, like the other admin routes it
+		// only exists if there's a token to guard it
+		if AdminToken == "" {
+			Error(w, r, ErrNoRoute)
+			return
+		}
+
+		Admin(AdminDebug(ids[1]))(w, r)
+	} else if len(ids) == 3 && ids[2] == "kick" {
+		// https://DOMAIN/convoId/kick
+		var (
+			convoId string = ids[1]
+			peer    *User
+			err     error
+		)
+
+		// check if the conversation actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// only the creator can kick the other user
+		if peer, err = Store.Peer(convoId, RequestIP(r)); err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		// remove the other user like they left, which tells the creator and
+		// frees the slot, unless they already left on their own
+		if Store.DeleteUser(peer, LEAVE_KICKED) {
+			close(peer.Stop)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	} else if len(ids) == 3 && ids[2] == "history" {
+		// https://DOMAIN/convoId/history
+		var (
+			convoId string = ids[1]
+			history []HistoryEntry
+			err     error
+		)
+
+		// check if the conversation actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// only participants can see the history
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		if history, err = Store.History(convoId); err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		// write each message like it was first announced, followed by
+		// whether or not it has been read
+		for _, entry := range history {
+			status := "unread"
+			if entry.Read {
+				status = "read"
+			}
+
+			fmt.Fprintf(
+				w,
+				"%d %s%s/%s %s\n",
+				entry.Seq,
+				URL,
+				convoId,
+				entry.MessageId,
+				status,
+			)
 		}
 	} else if len(ids) == 3 { // https://DOMAIN/convoId/messageId
 		var (
 			convoId   string = ids[1]
 			messageId string = ids[2]
-			data      []byte
+			message   *Message
 			err       error
 		)
 
+		// make sure this IP isn't reading messages too fast before
+		// anything else, every check below takes the room lock and a read
+		// can tell the other user it happened
+		if !ReadLimiter.Allow(RequestIP(r)) {
+			Error(w, r, ErrRateLimited)
+			return
+		}
+
+		// reads can be locked down like writes
+		if APIKeyReads {
+			if err = CheckAPIKey(r); err != nil {
+				Error(w, r, err)
+				return
+			}
+		}
+
 		// check if the conversation actually exists
 		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
 			return
 		}
 
 		// TODO: is this needed?
-		if !Store.IPExists(convoId, GetIP(r.RemoteAddr)) {
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
 			return
 		}
 
 		// attempt to read the message
-		if data, err = Store.ReadMessage(convoId, messageId); err != nil {
-			panic(err)
+		if message, err = Store.ReadMessage(convoId, messageId); err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		// write the raw data out to the client as whatever the sender said
+		// it was, or as bytes so binary messages download without being
+		// mangled
+		if message.ContentType != "" {
+			w.Header().Set("Content-Type", message.ContentType)
+		} else {
+			w.Header().Set("Content-Type", DEFAULT_CONTENT_TYPE)
+		}
+		// the sender picks the type, so a browser mustn't guess a different
+		// one or run anything the message contains
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		// return the sender's tag so the recipient can check the data
+		// wasn't changed on the way
+		if message.Tag != "" {
+			w.Header().Set(TAG_HEADER, message.Tag)
 		}
 
-		// write the raw data out to the client
-		w.Write(data)
+		// the message is only gone once the client has all of it, a client
+		// that drops halfway through can try again
+		if err = StreamBody(w, r, message.Data); err != nil {
+			slog.InfoContext(
+				r.Context(),
+				"message read interrupted",
+				"convoId", convoId,
+				"messageId", messageId,
+				"err", err,
+			)
+			return
+		}
+
+		// https://DOMAIN/convoId/messageId?peek=1 reads without deleting
+		if r.URL.Query().Get("peek") != "" {
+			return
+		}
+
+		if err = Store.FinishRead(convoId, messageId, RequestIP(r)); err != nil {
+			// the body is already sent, so there's no one left to tell
+			slog.DebugContext(
+				r.Context(),
+				"couldn't finish read",
+				"convoId", convoId,
+				"messageId", messageId,
+				"err", err,
+			)
+		}
+	} else {
+		Error(w, r, ErrNoRoute)
 	}
 }
 
@@ -151,36 +638,552 @@ func GET(w http.ResponseWriter, r *http.Request, ids []string) {
 // determines whether or not the request to add a message is valid and if so,
 // adds the message to the specified conversation.
 func PUT(w http.ResponseWriter, r *http.Request, ids []string) {
+	// a private instance turns away writes without the key before they get
+	// anywhere near the Store
+	if err := CheckAPIKey(r); err != nil {
+		Error(w, r, err)
+		return
+	}
+
 	if len(ids) == 2 { // https://DOMAIN/convoId
 		var (
-			convoId string = ids[1]
-			data    []byte
-			err     error
+			convoId     string = ids[1]
+			messageId   string
+			messageIds  []string
+			contentType string
+			data        []byte
+			messages    [][]byte
+			batch       bool = r.Header.Get(BATCH_HEADER) == "true"
+			err         error
 		)
 
 		// make sure a conversation with the convoId actually exists
 		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
 			return
 		}
 
 		// TODO: is this needed?
-		if !Store.IPExists(convoId, GetIP(r.RemoteAddr)) {
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		// the tag is optional, but it has to fit in a header when it's
+		// returned, and a batch has no one message it could be for
+		if err = CheckTag(r.Header.Get(TAG_HEADER)); err != nil {
+			Error(w, r, err)
+			return
+		}
+		if batch && r.Header.Get(TAG_HEADER) != "" {
+			Error(w, r, ErrBatchTag)
+			return
+		}
+
+		// the content type is optional too, but it has to be one that can
+		// be returned
+		if contentType, err = CheckContentType(
+			r.Header.Get("Content-Type"),
+		); err != nil {
+			Error(w, r, err)
 			return
 		}
 
-		// read the data from the request body
+		// read the data from the request body, without reading more than
+		// the largest message allowed
+		r.Body = http.MaxBytesReader(w, r.Body, MaxMessageBytes)
 		if data, err = ioutil.ReadAll(r.Body); err != nil {
-			panic(err)
+			// if the message was too big say so, otherwise the request
+			// itself is broken
+			if _, ok := err.(*http.MaxBytesError); ok {
+				http.Error(
+					w,
+					err.Error(),
+					http.StatusRequestEntityTooLarge,
+				)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		// a batch is several messages, one on each line
+		messages = [][]byte{data}
+		if batch {
+			messages = SplitBatch(data)
+		}
+
+		// an empty message would just be a link to nothing
+		if len(data) == 0 || len(messages) == 0 {
+			Error(w, r, ErrEmptyMessage)
+			return
+		}
+
+		// a batch bigger than a whole burst would be rate limited however
+		// long the sender waited, so tell them how many fit instead
+		if PutLimiter.Rate > 0 && len(messages) > PutLimiter.Burst {
+			http.Error(
+				w,
+				fmt.Sprintf(
+					"%s, at most %d can be sent at once",
+					ErrBatchTooLarge,
+					PutLimiter.Burst,
+				),
+				http.StatusBadRequest,
+			)
+			return
+		}
+
+		// make sure this IP isn't sending messages too fast, each message
+		// of a batch counts
+		if !PutLimiter.AllowN(RequestIP(r), len(messages)) {
+			Error(w, r, ErrRateLimited)
+			return
+		}
+
+		// add the whole batch at once, and tell the sender where each
+		// message ended up
+		if batch {
+			if messageIds, err = Store.AddMessages(
+				messages,
+				contentType,
+				convoId,
+				RequestIP(r),
+			); err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			for _, messageId := range messageIds {
+				fmt.Fprintf(
+					w,
+					"%s %s%s/%s\n",
+					messageId,
+					URL,
+					convoId,
+					messageId,
+				)
+			}
+			return
 		}
 
 		// attempt to add the message to the conversation
-		if err = Store.AddMessage(
+		if messageId, err = Store.AddMessage(
 			data,
+			r.Header.Get(TAG_HEADER),
+			contentType,
+			convoId,
+			RequestIP(r),
+		); err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		// tell the sender where the message ended up, so scripts know it
+		// was stored
+		w.Header().Set("Location", URL+convoId+"/"+messageId)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s%s/%s\n", messageId, URL, convoId, messageId)
+	} else if len(ids) == 3 && ids[2] == "typing" {
+		// https://DOMAIN/convoId/typing
+		var convoId string = ids[1]
+
+		// make sure a conversation with the convoId actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// only participants can say they're typing
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		// typing notifications are meant to be sent over and over, but not
+		// so fast that they flood the other user
+		if !TypingLimiter.Allow(RequestIP(r)) {
+			Error(w, r, ErrRateLimited)
+			return
+		}
+
+		if err := Store.Typing(convoId, RequestIP(r)); err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		Error(w, r, ErrNoRoute)
+	}
+}
+
+// DELETE is called when someone sends a DELETE request to the server. This
+// function removes the caller from the conversation, the same as if they had
+// closed their connection.
+func DELETE(w http.ResponseWriter, r *http.Request, ids []string) {
+	if len(ids) == 2 { // https://DOMAIN/convoId
+		var (
+			convoId string = ids[1]
+			user    *User
+		)
+
+		// make sure a conversation with the convoId actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// only participants can leave a conversation
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		// find the user the caller is connected as, they might have left
+		// since the check above
+		if user = Store.UserByIP(convoId, RequestIP(r)); user == nil {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		// remove the user from the conversation and end their stream, if
+		// they're already gone their connection is closing on its own
+		if Store.DeleteUser(user, LEAVE_LEFT) {
+			close(user.Stop)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	} else if len(ids) == 3 { // https://DOMAIN/convoId/messageId
+		var (
+			convoId   string = ids[1]
+			messageId string = ids[2]
+		)
+
+		// make sure a conversation with the convoId actually exists
+		if !Store.IsConvo(convoId) {
+			Error(w, r, ErrConvoGone)
+			return
+		}
+
+		// only participants can cancel messages
+		if !Store.IPExists(convoId, RequestIP(r)) {
+			Error(w, r, ErrNotParticipant)
+			return
+		}
+
+		// attempt to cancel the message, only its sender can
+		if err := Store.CancelMessage(
 			convoId,
-			GetIP(r.RemoteAddr),
+			messageId,
+			RequestIP(r),
 		); err != nil {
-			panic(err)
+			Error(w, r, err)
+			return
 		}
+
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		Error(w, r, ErrNoRoute)
+	}
+}
+
+// HEAD is called when someone makes a HEAD request to the server. Only the
+// landing page can be asked for without a body, any other GET has side effects
+// (like creating or joining a conversation) a HEAD shouldn't have.
+func HEAD(w http.ResponseWriter, r *http.Request, ids []string) {
+	if len(ids) == 2 && len(ids[1]) == 0 { // https://DOMAIN/
+		// net/http drops the body of a HEAD response, the headers are the
+		// same as a GET's
+		Landing(w, r)
+		return
+	}
+
+	MethodNotAllowed(w)
+}
+
+// Landing writes the landing page.
+func Landing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", LandingCacheControl())
+	WriteBodyStatus(w, r, LandingStatus, LandingPage())
+}
+
+// MethodNotAllowed tells the client which methods it can use instead.
+func MethodNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Allow", ALLOWED_METHODS)
+	http.Error(
+		w,
+		http.StatusText(http.StatusMethodNotAllowed),
+		http.StatusMethodNotAllowed,
+	)
+}
+
+// OPTIONS is called when a browser sends a CORS preflight request before a
+// PUT or DELETE. This function tells the browser which methods and headers
+// are allowed, the allowed origin is set for every request.
+func OPTIONS(w http.ResponseWriter, r *http.Request, ids []string) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE")
+	w.Header().Set(
+		"Access-Control-Allow-Headers",
+		strings.Join([]string{
+			"Accept",
+			"Content-Type",
+			"Last-Event-ID",
+			TAG_HEADER,
+			PASSWORD_HEADER,
+			BATCH_HEADER,
+			PING_INTERVAL_HEADER,
+			NICK_HEADER,
+			API_KEY_HEADER,
+			"Authorization",
+		}, ", "),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Redirect is called for every request to the plain HTTP listener. This
+// function sends the client to the same path over HTTPS.
+func Redirect(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.RequestURI()
+
+	// URL already ends with the BasePath, so it's taken off the request or
+	// it would be in the new one twice
+	if rest, ok := strings.CutPrefix(uri, BasePath); ok && BasePath != "" &&
+		(rest == "" || rest[0] == '/' || rest[0] == '?') {
+		uri = rest
+	}
+
+	http.Redirect(
+		w,
+		r,
+		URL+strings.TrimPrefix(uri, "/"),
+		http.StatusMovedPermanently,
+	)
+}
+
+// Health is called when a load balancer checks whether the server is alive. It
+// always responds, no matter the User-Agent, and reports how many
+// conversations are active without touching any of them.
+func Health(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok %d\n", Store.Count())
+}
+
+// Error writes err to the client with the status code that matches it. Errors
+// that aren't the client's fault get a 500, and are logged as errors.
+func Error(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+
+	switch err {
+	case ErrAPIKey:
+		status = http.StatusUnauthorized
+	case ErrBadTag, ErrEmptyMessage, ErrBadContentType, ErrBatchTag,
+		ErrBatchTooLarge, ErrBadPingInterval, ErrBadNick:
+		status = http.StatusBadRequest
+	case ErrConvoGone, ErrNoMessage, ErrNoRoute, ErrNoPeer:
+		status = http.StatusNotFound
+	case ErrConvoFull, ErrSameIP:
+		status = http.StatusConflict
+	case ErrNotParticipant, ErrNotSender, ErrWrongPassword, ErrNotCreator,
+		ErrKicked:
+		status = http.StatusForbidden
+	case ErrRateLimited, ErrTooManyConvos:
+		status = http.StatusTooManyRequests
+	case ErrRoomFull, ErrBusy:
+		status = http.StatusServiceUnavailable
+	case ErrConvoStorageFull, ErrServerStorageFull:
+		status = http.StatusInsufficientStorage
+	case ErrLongPath:
+		status = http.StatusRequestURITooLong
+	default:
+		status = http.StatusInternalServerError
+	}
+
+	if status == http.StatusInternalServerError {
+		slog.ErrorContext(
+			r.Context(),
+			"request failed",
+			"path", r.URL.Path,
+			"ip", RequestIP(r),
+			"err", err,
+		)
+	} else {
+		slog.DebugContext(
+			r.Context(),
+			"request rejected",
+			"path", r.URL.Path,
+			"ip", RequestIP(r),
+			"status", status,
+			"err", err,
+		)
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// IsBrowser determines whether or not a request wants the landing page. Only
+// browsers ask for HTML, and adding ?raw to the URL forces CLI mode for any
+// client that asks for HTML anyway.
+func IsBrowser(r *http.Request) bool {
+	if _, ok := r.URL.Query()["raw"]; ok {
+		return false
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// BuildURL returns the https://DOMAIN:PORT/ string sent in messages. The port
+// is left out when it's the https default, since clients add it themselves.
+func BuildURL(domain string, port int) string {
+	if port == HTTPS_PORT {
+		return fmt.Sprintf(URL_FORMAT, domain)
+	}
+
+	return fmt.Sprintf(URL_PORT_FORMAT, domain, port)
+}
+
+// CleanBasePath turns a -base-path into the form BasePath is kept in, with a
+// leading slash and no trailing one, or empty for the root.
+func CleanBasePath(basePath string) string {
+	basePath = path.Clean("/" + basePath)
+	if basePath == "/" {
+		return ""
+	}
+
+	return basePath
+}
+
+// StripBasePath returns a handler that takes the BasePath off the front of
+// each request's path before handler is called, so every route is matched the
+// same way with or without one. Paths outside the BasePath don't exist.
+func StripBasePath(handler http.Handler) http.Handler {
+	if BasePath == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, BasePath)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+
+		// the request is shared with the logging, so change a copy
+		stripped := r.Clone(r.Context())
+		stripped.URL.Path = rest
+		stripped.URL.RawPath = ""
+
+		handler.ServeHTTP(w, stripped)
+	})
+}
+
+// invalid reports a bad flag value and exits, the same way the flag package
+// does for values it can't parse.
+func invalid(name string, value interface{}, reason string) {
+	fmt.Fprintf(
+		os.Stderr,
+		"invalid value \"%v\" for flag -%s: %s\n",
+		value, name, reason,
+	)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// Handler returns the handler for every route the server has, wrapped to log
+// each request and turn away IPs that aren't allowed before anything else. The
+// flags have to be read before calling it, since they decide which routes
+// exist. A test can serve it with httptest.NewTLSServer.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// the health check and metrics get their own routes so they never reach
+	// the landing page or conversation logic below
+	mux.HandleFunc("/healthz", Health)
+	mux.Handle("/metrics", Stats)
+
+	// the admin routes only exist if there's a token to guard them
+	if AdminToken != "" {
+		mux.HandleFunc("/admin/convos/", Admin(AdminConvos))
+		mux.HandleFunc("/stats", Admin(AdminStats))
+	}
+
+	// everything else is a conversation, or the landing page
+	mux.HandleFunc("/", Route)
+
+	return LogRequests(Lists.Wrap(StripBasePath(mux)))
+}
+
+// Route is called for every request that isn't for one of the routes of its
+// own, and routes it to GET, PUT, DELETE, HEAD or OPTIONS accordingly.
+func Route(w http.ResponseWriter, r *http.Request) {
+	// a panic shouldn't take the whole connection down with it, so
+	// report it and give the client a 500 instead
+	defer func() {
+		if err := recover(); err != nil {
+			slog.ErrorContext(
+				r.Context(),
+				"panic serving request",
+				"path", r.URL.Path,
+				"ip", RequestIP(r),
+				"err", err,
+			)
+			http.Error(
+				w,
+				http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError,
+			)
+		}
+	}()
+
+	// browsers need this on every response, not just the preflight
+	w.Header().Set("Access-Control-Allow-Origin", CORSOrigin)
+	// and they can't read the tag of a message, or where a sent message
+	// ended up, without this
+	w.Header().Set(
+		"Access-Control-Expose-Headers",
+		TAG_HEADER+", Location",
+	)
+
+	// clean the path first so doubled and trailing slashes don't
+	// change which route it is
+	ids := strings.Split(path.Clean(r.URL.Path), "/")
+
+	// ids are used as map keys, so turn away anything too long to be one
+	// before it gets near the Store
+	for _, id := range ids {
+		if len(id) > MaxSegmentLength {
+			Error(w, r, ErrLongPath)
+			return
+		}
+	}
+
+	// ids typed in the wrong case are the same ids, and route names are
+	// matched in any case so an uppercase alphabet doesn't hide them
+	for i := range ids {
+		if name := strings.ToLower(ids[i]); RouteNames[name] {
+			ids[i] = name
+		} else {
+			ids[i] = NormalizeId(ids[i])
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		GET(w, r, ids)
+	case "PUT":
+		PUT(w, r, ids)
+	case "DELETE":
+		DELETE(w, r, ids)
+	case "HEAD":
+		HEAD(w, r, ids)
+	case "OPTIONS":
+		OPTIONS(w, r, ids)
+	default:
+		MethodNotAllowed(w)
 	}
 }
 
@@ -196,6 +1199,17 @@ func main() {
 			DEFAULT_PORT,
 			"port number to listen on",
 		)
+		basePathPtr = flag.String(
+			"base-path",
+			"",
+			"path the server is served under behind a reverse proxy, like "+
+				"/convo (the root if empty)",
+		)
+		bindPtr = flag.String(
+			"bind",
+			"",
+			"IP address to listen on (all of them if empty)",
+		)
 		certPtr = flag.String(
 			"cert",
 			DEFAULT_CERT_LOCATION,
@@ -206,25 +1220,589 @@ func main() {
 			DEFAULT_KEY_LOCATION,
 			"SSL key filepath",
 		)
+		certReloadPtr = flag.Duration(
+			"cert-reload-interval",
+			DEFAULT_CERT_RELOAD_INTERVAL,
+			"how often the SSL files are checked for a renewed certificate "+
+				"(0 for never)",
+		)
+		pingPtr = flag.Duration(
+			"ping-interval",
+			DEFAULT_PING_INTERVAL,
+			"how often conversations are pinged to keep connections open",
+		)
+		pingDotsPtr = flag.Bool(
+			"ping-dots",
+			true,
+			"write a visible \".\" to plaintext users on each ping "+
+				"(JSON users always get a ping event)",
+		)
+		sseEventsPtr = flag.Bool(
+			"sse-events",
+			false,
+			"write events to EventSource clients with event: and data: "+
+				"fields, so they can listen for each type",
+		)
+		keepalivePtr = flag.Duration(
+			"keepalive",
+			DEFAULT_KEEPALIVE,
+			"how often a comment keeps each stream open (0 for never)",
+		)
+		retryPtr = flag.Duration(
+			"retry",
+			DEFAULT_RETRY,
+			"how long clients wait before reconnecting (0 to leave it to them)",
+		)
+		writeTimeoutPtr = flag.Duration(
+			"write-timeout",
+			DEFAULT_WRITE_TIMEOUT,
+			"how long a write to a user can take (0 for forever)",
+		)
+		maxConnectionPtr = flag.Duration(
+			"max-connection-duration",
+			DEFAULT_MAX_CONNECTION_DURATION,
+			"how long a user can stay connected (0 for forever)",
+		)
+		reconnectGracePtr = flag.Duration(
+			"reconnect-grace",
+			DEFAULT_RECONNECT_GRACE,
+			"how long a conversation waits for its last user to reconnect",
+		)
+		restoreGracePtr = flag.Duration(
+			"restore-grace",
+			DEFAULT_RESTORE_GRACE,
+			"how long a restored conversation waits for its users to rejoin",
+		)
+		ttlPtr = flag.Duration(
+			"message-ttl",
+			DEFAULT_MESSAGE_TTL,
+			"how long a message can go unread before it expires (0 to disable)",
+		)
+		idlePtr = flag.Duration(
+			"idle-timeout",
+			DEFAULT_IDLE_TIMEOUT,
+			"how long a conversation can go without messages being sent or "+
+				"read before it ends (0 to disable)",
+		)
+		joinPtr = flag.Duration(
+			"join-timeout",
+			DEFAULT_JOIN_TIMEOUT,
+			"how long a new conversation waits for someone to join before "+
+				"it ends (0 to disable)",
+		)
+		idLengthPtr = flag.Int(
+			"id-length",
+			DEFAULT_ID_LENGTH,
+			"number of characters in conversation and message ids",
+		)
+		idAlphabetPtr = flag.String(
+			"id-alphabet",
+			ID_ALPHABET,
+			"characters conversation and message ids are made from",
+		)
+		ratePtr = flag.Float64(
+			"rate",
+			DEFAULT_RATE,
+			"messages each IP can send per second (0 to disable)",
+		)
+		burstPtr = flag.Int(
+			"burst",
+			DEFAULT_BURST,
+			"messages each IP can send in a single burst",
+		)
+		readRatePtr = flag.Float64(
+			"read-rate",
+			DEFAULT_READ_RATE,
+			"messages each IP can read per second (0 to disable)",
+		)
+		readBurstPtr = flag.Int(
+			"read-burst",
+			DEFAULT_READ_BURST,
+			"messages each IP can read in a single burst",
+		)
+		joinRatePtr = flag.Float64(
+			"join-rate",
+			DEFAULT_JOIN_RATE,
+			"passwords each IP can try per second (0 to disable)",
+		)
+		joinBurstPtr = flag.Int(
+			"join-burst",
+			DEFAULT_JOIN_BURST,
+			"passwords each IP can try in a single burst",
+		)
+		maxConvosPtr = flag.Int(
+			"max-convos",
+			DEFAULT_MAX_CONVOS,
+			"conversations that can exist at once (0 for no limit)",
+		)
+		maxCreatesPtr = flag.Int(
+			"max-concurrent-creates",
+			DEFAULT_MAX_CONCURRENT_CREATES,
+			"conversations that can be in the middle of being created at "+
+				"once (0 for no limit)",
+		)
+		maxConvosPerIPPtr = flag.Int(
+			"max-convos-per-ip",
+			DEFAULT_MAX_CONVOS_PER_IP,
+			"conversations each ip can be in when creating one (0 for no limit)",
+		)
+		pipeDepthPtr = flag.Int(
+			"pipe-depth",
+			DEFAULT_PIPE_DEPTH,
+			fmt.Sprintf(
+				"events that can wait for a slow user before new ones are "+
+					"dropped (at least %d)",
+				MIN_PIPE_DEPTH,
+			),
+		)
+		maxConvoMessagesPtr = flag.Int(
+			"max-messages-per-convo",
+			DEFAULT_MAX_CONVO_MESSAGES,
+			"messages a conversation can hold, read history evicted first "+
+				"(0 for no limit)",
+		)
+		maxConvoBytesPtr = flag.Int64(
+			"max-bytes-per-convo",
+			DEFAULT_MAX_CONVO_BYTES,
+			"bytes of messages a conversation can hold, read history evicted "+
+				"first (0 for no limit)",
+		)
+		maxTotalBytesPtr = flag.Int64(
+			"max-total-bytes",
+			DEFAULT_MAX_TOTAL_BYTES,
+			"bytes of messages every conversation together can hold (0 for "+
+				"no limit)",
+		)
+		maxBytesPtr = flag.Int64(
+			"max-message-bytes",
+			DEFAULT_MAX_MESSAGE_BYTES,
+			"largest message that can be sent, in bytes",
+		)
+		maxSegmentPtr = flag.Int(
+			"max-segment-length",
+			DEFAULT_MAX_SEGMENT_LENGTH,
+			"longest part of a path between slashes, in bytes",
+		)
+		allowlistPtr = flag.String(
+			"allowlist",
+			"",
+			"file of CIDR ranges that can connect (everyone if empty)",
+		)
+		blocklistPtr = flag.String(
+			"blocklist",
+			"",
+			"file of CIDR ranges that can't connect",
+		)
+		statePtr = flag.String(
+			"state-file",
+			"",
+			"file conversations are saved to on shutdown and loaded from on "+
+				"startup, without their live connections",
+		)
+		tlsMinPtr = flag.String(
+			"tls-min",
+			DEFAULT_TLS_MIN,
+			"oldest TLS version to negotiate (1.2 or 1.3)",
+		)
+		tlsMaxPtr = flag.String(
+			"tls-max",
+			DEFAULT_TLS_MAX,
+			"newest TLS version to negotiate (1.2 or 1.3)",
+		)
+		corsPtr = flag.String(
+			"cors-origin",
+			DEFAULT_CORS_ORIGIN,
+			"origin browsers can make requests from",
+		)
+		redirectPtr = flag.Bool(
+			"http-redirect",
+			false,
+			"also listen for plain HTTP on port 80 and redirect it to HTTPS",
+		)
+		gzipPtr = flag.Bool(
+			"gzip",
+			true,
+			"gzip the landing page and messages for clients that accept it",
+		)
+		publicStatusPtr = flag.Bool(
+			"public-status",
+			false,
+			"let anyone with a link see how many users are in the conversation",
+		)
+		logSummariesPtr = flag.Bool(
+			"log-summaries",
+			false,
+			"log the message count, length and ips of conversations that end",
+		)
+		keepHistoryPtr = flag.Bool(
+			"keep-history",
+			false,
+			"keep read messages so they can be read again",
+		)
+		allowQueuePtr = flag.Bool(
+			"allow-queue",
+			false,
+			"let users joining a full conversation wait for a slot",
+		)
+		anonymousPtr = flag.Bool(
+			"anonymous",
+			false,
+			"call users without a nickname \"anonymous\" instead of by "+
+				"their IP",
+		)
+		hideIPsPtr = flag.Bool(
+			"hide-ips",
+			false,
+			"call users without a nickname by a pseudonym instead of by "+
+				"their IP, the same one throughout a conversation",
+		)
+		allowSameIPPtr = flag.Bool(
+			"allow-same-ip",
+			false,
+			"let both users of a conversation have the same IP, for testing",
+		)
+		apiKeyPtr = flag.String(
+			"api-key",
+			"",
+			"key needed in X-API-Key or as a bearer token to send messages "+
+				"(disabled if empty)",
+		)
+		apiKeyReadsPtr = flag.Bool(
+			"api-key-reads",
+			false,
+			"need the -api-key to read messages too",
+		)
+		adminTokenPtr = flag.String(
+			"admin-token",
+			"",
+			"bearer token for the /admin/ routes (disabled if empty)",
+		)
+		webhookPtr = flag.String(
+			"webhook",
+			"",
+			"URL to post JSON to when conversations are created, joined, "+
+				"get messages or are deleted (disabled if empty)",
+		)
+		trustProxyPtr = flag.Bool(
+			"trust-proxy",
+			false,
+			"read client IPs from X-Forwarded-For or X-Real-IP, only use "+
+				"this behind a reverse proxy",
+		)
+		http2Ptr = flag.Bool(
+			"http2",
+			false,
+			"serve HTTP/2 as well as HTTP/1.1",
+		)
+		landingPagePtr = flag.String(
+			"landing-page",
+			"",
+			"HTML file to serve as the landing page (the built in one if empty)",
+		)
+		landingReloadPtr = flag.Bool(
+			"landing-page-reload",
+			false,
+			"read the landing page on every request, for editing it",
+		)
+		landingStatusPtr = flag.Int(
+			"landing-status",
+			http.StatusOK,
+			"status to serve the landing page with, like 503 with a "+
+				"-landing-page for maintenance",
+		)
+		checkPtr = flag.Bool(
+			"check",
+			false,
+			"check the configuration and exit without serving",
+		)
+		logLevelPtr = flag.String(
+			"log-level",
+			DEFAULT_LOG_LEVEL,
+			"least important log lines to write (debug, info, warn, error)",
+		)
 	)
 
 	flag.Parse()
 
-	// only add the port to the url if the domain is localhost
-	//
-	// TODO: find a better way to do this? maybe another flag?
-	if *domainPtr != "localhost" {
-		URL = fmt.Sprintf(URL_FORMAT, *domainPtr)
-	} else {
-		URL = fmt.Sprintf(URL_PORT_FORMAT, *domainPtr, *portPtr)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevelPtr)); err != nil {
+		invalid("log-level", *logLevelPtr, "must be debug, info, warn or error")
+	}
+	slog.SetDefault(slog.New(ContextHandler{slog.NewTextHandler(
+		os.Stderr,
+		&slog.HandlerOptions{Level: level},
+	)}))
+
+	// a ping interval of zero would flood the users with pings, and a
+	// negative one makes no sense at all
+	if *pingPtr <= 0 {
+		invalid("ping-interval", *pingPtr, "must be positive")
+	}
+	PingInterval = *pingPtr
+
+	PingDots = *pingDotsPtr
+	SSEEvents = *sseEventsPtr
+
+	if *keepalivePtr < 0 {
+		invalid("keepalive", *keepalivePtr, "must not be negative")
+	}
+	Keepalive = *keepalivePtr
+
+	// without the dots, the keepalive comments are all that keep plaintext
+	// streams open
+	if !PingDots && Keepalive == 0 {
+		invalid("keepalive", *keepalivePtr, "can't be 0 without ping dots")
+	}
+
+	if *retryPtr < 0 {
+		invalid("retry", *retryPtr, "must not be negative")
+	}
+	Retry = *retryPtr
+
+	if *writeTimeoutPtr < 0 {
+		invalid("write-timeout", *writeTimeoutPtr, "must not be negative")
+	}
+	WriteTimeout = *writeTimeoutPtr
+
+	if *maxConnectionPtr < 0 {
+		invalid(
+			"max-connection-duration",
+			*maxConnectionPtr,
+			"must not be negative",
+		)
+	}
+	MaxConnectionDuration = *maxConnectionPtr
+
+	if *reconnectGracePtr < 0 {
+		invalid("reconnect-grace", *reconnectGracePtr, "must not be negative")
+	}
+	ReconnectGrace = *reconnectGracePtr
+
+	if *restoreGracePtr <= 0 {
+		invalid("restore-grace", *restoreGracePtr, "must be positive")
+	}
+	RestoreGrace = *restoreGracePtr
+
+	if *ttlPtr < 0 {
+		invalid("message-ttl", *ttlPtr, "must not be negative")
+	}
+	MessageTTL = *ttlPtr
+
+	if *idlePtr < 0 {
+		invalid("idle-timeout", *idlePtr, "must not be negative")
+	}
+	IdleTimeout = *idlePtr
+
+	if *joinPtr < 0 {
+		invalid("join-timeout", *joinPtr, "must not be negative")
+	}
+	JoinTimeout = *joinPtr
+
+	if *idLengthPtr < 1 {
+		invalid("id-length", *idLengthPtr, "must be at least 1")
+	}
+	if err := CheckIdAlphabet(*idAlphabetPtr); err != nil {
+		invalid("id-alphabet", *idAlphabetPtr, err.Error())
+	}
+	IdLength = *idLengthPtr
+	IdAlphabet = *idAlphabetPtr
+
+	if bits := IdBits(IdLength, IdAlphabet); bits < MIN_ID_BITS {
+		slog.Warn(
+			"ids are short enough to be guessed",
+			"bits", math.Floor(bits),
+			"recommended", MIN_ID_BITS,
+		)
+	}
+
+	if *ratePtr < 0 {
+		invalid("rate", *ratePtr, "must not be negative")
+	}
+	if *burstPtr < 1 {
+		invalid("burst", *burstPtr, "must be at least 1")
+	}
+	PutLimiter = NewLimiter(*ratePtr, *burstPtr)
+
+	if *readRatePtr < 0 {
+		invalid("read-rate", *readRatePtr, "must not be negative")
+	}
+	if *readBurstPtr < 1 {
+		invalid("read-burst", *readBurstPtr, "must be at least 1")
+	}
+	ReadLimiter = NewLimiter(*readRatePtr, *readBurstPtr)
+
+	if *joinRatePtr < 0 {
+		invalid("join-rate", *joinRatePtr, "must not be negative")
+	}
+	if *joinBurstPtr < 1 {
+		invalid("join-burst", *joinBurstPtr, "must be at least 1")
+	}
+	JoinLimiter = NewLimiter(*joinRatePtr, *joinBurstPtr)
+
+	if *maxConvosPtr < 0 {
+		invalid("max-convos", *maxConvosPtr, "can't be negative")
+	}
+	MaxConvos = *maxConvosPtr
+
+	if *maxConvosPerIPPtr < 0 {
+		invalid("max-convos-per-ip", *maxConvosPerIPPtr, "can't be negative")
+	}
+	MaxConvosPerIP = *maxConvosPerIPPtr
+
+	if *maxCreatesPtr < 0 {
+		invalid("max-concurrent-creates", *maxCreatesPtr, "can't be negative")
+	}
+	Creating = NewSemaphore(*maxCreatesPtr)
+
+	if *pipeDepthPtr < MIN_PIPE_DEPTH {
+		invalid(
+			"pipe-depth",
+			*pipeDepthPtr,
+			fmt.Sprintf(
+				"must be at least %d to hold a replay of the event backlog",
+				MIN_PIPE_DEPTH,
+			),
+		)
+	}
+	PipeDepth = *pipeDepthPtr
+
+	if *maxConvoMessagesPtr < 0 {
+		invalid(
+			"max-messages-per-convo",
+			*maxConvoMessagesPtr,
+			"can't be negative",
+		)
+	}
+	MaxConvoMessages = *maxConvoMessagesPtr
+
+	if *maxConvoBytesPtr < 0 {
+		invalid("max-bytes-per-convo", *maxConvoBytesPtr, "can't be negative")
+	}
+	MaxConvoBytes = *maxConvoBytesPtr
+
+	if *maxTotalBytesPtr < 0 {
+		invalid("max-total-bytes", *maxTotalBytesPtr, "can't be negative")
+	}
+	MaxTotalBytes = *maxTotalBytesPtr
+
+	if *maxBytesPtr < 1 {
+		invalid("max-message-bytes", *maxBytesPtr, "must be at least 1")
+	}
+	MaxMessageBytes = *maxBytesPtr
+
+	if *maxSegmentPtr < 1 {
+		invalid("max-segment-length", *maxSegmentPtr, "must be at least 1")
+	}
+	MaxSegmentLength = *maxSegmentPtr
+
+	if _, ok := TLS_VERSIONS[*tlsMinPtr]; !ok {
+		invalid("tls-min", *tlsMinPtr, "must be 1.2 or 1.3")
+	}
+	if _, ok := TLS_VERSIONS[*tlsMaxPtr]; !ok {
+		invalid("tls-max", *tlsMaxPtr, "must be 1.2 or 1.3")
+	}
+	if TLS_VERSIONS[*tlsMinPtr] > TLS_VERSIONS[*tlsMaxPtr] {
+		invalid("tls-min", *tlsMinPtr, "must not be newer than -tls-max")
+	}
+	TLSCONFIG.MinVersion = TLS_VERSIONS[*tlsMinPtr]
+	TLSCONFIG.MaxVersion = TLS_VERSIONS[*tlsMaxPtr]
+
+	if *certReloadPtr < 0 {
+		invalid("cert-reload-interval", *certReloadPtr, "can't be negative")
+	}
+
+	TrustProxy = *trustProxyPtr
+	CORSOrigin = *corsPtr
+	AdminToken = *adminTokenPtr
+	APIKey = *apiKeyPtr
+	if *apiKeyReadsPtr && APIKey == "" {
+		invalid("api-key-reads", *apiKeyReadsPtr, "needs an -api-key")
+	}
+	APIKeyReads = *apiKeyReadsPtr
+
+	// the webhook has to be somewhere the server can post to
+	if *webhookPtr != "" {
+		if parsed, err := url.Parse(*webhookPtr); err != nil ||
+			(parsed.Scheme != "http" && parsed.Scheme != "https") ||
+			parsed.Host == "" {
+			invalid("webhook", *webhookPtr, "must be an http or https URL")
+		}
+		Hooks.URL = *webhookPtr
+		go Hooks.Run()
+	}
+
+	AllowQueue = *allowQueuePtr
+	AllowSameIP = *allowSameIPPtr
+	Anonymous = *anonymousPtr
+	HideIPs = *hideIPsPtr
+	KeepHistory = *keepHistoryPtr
+	LogSummaries = *logSummariesPtr
+	PublicStatus = *publicStatusPtr
+	Gzip = *gzipPtr
+
+	LandingPath = *landingPagePtr
+	LandingReload = *landingReloadPtr
+	if *landingStatusPtr < 200 || *landingStatusPtr > 599 {
+		invalid("landing-status", *landingStatusPtr, "must be from 200 to 599")
+	}
+	LandingStatus = *landingStatusPtr
+	landing = LoadLandingPage()
+
+	Lists.AllowPath = *allowlistPtr
+	Lists.BlockPath = *blocklistPtr
+	if err := Lists.Load(); err != nil {
+		slog.Error("couldn't load ip lists", "err", err)
+		os.Exit(1)
+	}
+
+	BasePath = CleanBasePath(*basePathPtr)
+	URL = BuildURL(*domainPtr, *portPtr)
+	if BasePath != "" {
+		URL += BasePath[1:] + "/"
+	}
+
+	// the listeners only bind to the -bind address, if there is one
+	if *bindPtr != "" && net.ParseIP(*bindPtr) == nil {
+		invalid("bind", *bindPtr, "must be an IP address")
+	}
+	var (
+		addr         = net.JoinHostPort(*bindPtr, strconv.Itoa(*portPtr))
+		redirectAddr string
+	)
+	if *redirectPtr {
+		redirectAddr = net.JoinHostPort(
+			*bindPtr,
+			strconv.Itoa(HTTP_REDIRECT_PORT),
+		)
+	}
+
+	// the flags are fine by now, so only the things that could still stop
+	// the server from starting are left to check
+	if *checkPtr {
+		if !Check(*certPtr, *keyPtr, addr, redirectAddr) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// the certificate is handed out through GetCertificate rather than
+	// loaded by ListenAndServeTLS, so it can be swapped when it's renewed
+	Keys.CertPath = *certPtr
+	Keys.KeyPath = *keyPtr
+	if err := Keys.Load(); err != nil {
+		slog.Error("couldn't load certificate", "err", err)
+		os.Exit(1)
+	}
+	TLSCONFIG.GetCertificate = Keys.GetCertificate
+	if *certReloadPtr > 0 {
+		go Keys.Watch(*certReloadPtr)
 	}
 
 	var (
 		err    error
-		mux    *http.ServeMux = http.NewServeMux()
-		server http.Server    = http.Server{
-			Addr:      fmt.Sprintf(":%d", *portPtr),
-			Handler:   mux,
+		server http.Server = http.Server{
+			Addr:      addr,
+			Handler:   Handler(),
 			TLSConfig: TLSCONFIG,
 			TLSNextProto: make(map[string]func(
 				*http.Server,
@@ -232,23 +1810,107 @@ func main() {
 				http.Handler,
 			), 0),
 		}
+		// redirect is the optional plain HTTP listener
+		redirect http.Server = http.Server{
+			Addr:    redirectAddr,
+			Handler: http.HandlerFunc(Redirect),
+		}
 	)
 
-	// this handles all incoming requests and routes them to GET or PUT
-	// accordingly
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		ids := strings.Split(r.URL.Path, "/")
-		switch r.Method {
-		case "GET":
-			GET(w, r, ids)
-		case "PUT":
-			PUT(w, r, ids)
+	// HTTP/2 is turned on by leaving TLSNextProto nil. Streams still work,
+	// the ResponseController flushes each event in its own frame and a
+	// closed stream cancels the request context like a closed connection
+	// does. HTTP/2 needs an AES_128_GCM cipher suite for TLS 1.2, which isn't
+	// in the list otherwise
+	if *http2Ptr {
+		server.TLSNextProto = nil
+		TLSCONFIG.CipherSuites = append(
+			TLSCONFIG.CipherSuites,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		)
+	}
+
+	// bring back the conversations from the last run
+	if *statePtr != "" {
+		if err = Store.Load(*statePtr); err != nil {
+			slog.Error("couldn't load state", "file", *statePtr, "err", err)
+			os.Exit(1)
 		}
-	})
+	}
+
+	// one goroutine pings every conversation, instead of one for each
+	go Store.Ping()
 
-	println("listening on " + URL)
+	// on shutdown save the conversations before closing, because closing
+	// drops every connection and that deletes the conversations. Then the
+	// users are told, and their streams end, before the server stops
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
 
-	if err = server.ListenAndServeTLS(*certPtr, *keyPtr); err != nil {
-		panic(err)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		if *statePtr != "" {
+			if err := Store.Save(*statePtr); err != nil {
+				slog.Error(
+					"couldn't save state",
+					"file", *statePtr,
+					"err", err,
+				)
+			}
+		}
+
+		Store.Close()
+
+		// give the streams a moment to write their last events
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			SHUTDOWN_TIMEOUT,
+		)
+		defer cancel()
+
+		redirect.Close()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}()
+
+	// reload the ip lists on SIGHUP, so IPs can be blocked without dropping
+	// every connection
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			if err := Lists.Load(); err != nil {
+				slog.Error("couldn't reload ip lists", "err", err)
+				continue
+			}
+			slog.Info("reloaded ip lists")
+		}
+	}()
+
+	// the redirect listener runs next to the main server, and doesn't take
+	// it down if it fails
+	if *redirectPtr {
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil &&
+				err != http.ErrServerClosed {
+				slog.Error("redirect listener stopped", "err", err)
+			}
+		}()
 	}
+
+	slog.Info("listening", "url", URL, "addr", addr)
+
+	if err = server.ListenAndServeTLS("", ""); err != nil &&
+		err != http.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+
+	// ListenAndServeTLS returns as soon as shutting down starts, so wait for
+	// it to finish
+	<-stopped
 }
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProtocol(t *testing.T) {
+	server := newTestServer(t)
+	alice := server.client(t, "10.0.0.1")
+	bob := server.client(t, "10.0.0.2")
+
+	aliceStream, convoId := alice.create()
+
+	// each side hears who the other is
+	bobStream := bob.join(convoId)
+	aliceStream.expect("> 10.0.0.2 ")
+	bobStream.expect("> 10.0.0.1 ")
+
+	// the recipient gets "+", the sender gets their own message indented
+	url := bob.put(convoId, "hello")
+	if !strings.HasPrefix(url, URL+convoId+"/") {
+		t.Fatalf("message url %q isn't in the conversation", url)
+	}
+	aliceStream.expect("+ 1 " + url)
+	bobStream.expect("  1 " + url)
+
+	// reading it tells the sender who read it
+	if message := alice.read(url); message != "hello" {
+		t.Fatalf("read %q, want %q", message, "hello")
+	}
+	bobStream.expect("- " + url + " 10.0.0.1 ")
+	aliceStream.expect("- " + url + " 10.0.0.1 ")
+
+	// leaving tells the other side why
+	if status, body := bob.text("DELETE", "/"+convoId, ""); status !=
+		http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", status, body)
+	}
+	bobStream.ended()
+	aliceStream.expect("< 10.0.0.2 ")
+}
+
+func TestErrorStatus(t *testing.T) {
+	// every exported error has to be here, so one added without a status
+	// fails this test instead of being a 500
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"ErrAPIKey", ErrAPIKey, http.StatusUnauthorized},
+		{"ErrBadTag", ErrBadTag, http.StatusBadRequest},
+		{"ErrEmptyMessage", ErrEmptyMessage, http.StatusBadRequest},
+		{"ErrBadContentType", ErrBadContentType, http.StatusBadRequest},
+		{"ErrBatchTag", ErrBatchTag, http.StatusBadRequest},
+		{"ErrBatchTooLarge", ErrBatchTooLarge, http.StatusBadRequest},
+		{"ErrBadPingInterval", ErrBadPingInterval, http.StatusBadRequest},
+		{"ErrBadNick", ErrBadNick, http.StatusBadRequest},
+		{"ErrConvoGone", ErrConvoGone, http.StatusNotFound},
+		{"ErrNoMessage", ErrNoMessage, http.StatusNotFound},
+		{"ErrNoRoute", ErrNoRoute, http.StatusNotFound},
+		{"ErrNoPeer", ErrNoPeer, http.StatusNotFound},
+		{"ErrConvoFull", ErrConvoFull, http.StatusConflict},
+		{"ErrSameIP", ErrSameIP, http.StatusConflict},
+		{"ErrNotParticipant", ErrNotParticipant, http.StatusForbidden},
+		{"ErrNotSender", ErrNotSender, http.StatusForbidden},
+		{"ErrWrongPassword", ErrWrongPassword, http.StatusForbidden},
+		{"ErrNotCreator", ErrNotCreator, http.StatusForbidden},
+		{"ErrKicked", ErrKicked, http.StatusForbidden},
+		{"ErrRateLimited", ErrRateLimited, http.StatusTooManyRequests},
+		{"ErrTooManyConvos", ErrTooManyConvos, http.StatusTooManyRequests},
+		{"ErrRoomFull", ErrRoomFull, http.StatusServiceUnavailable},
+		{"ErrBusy", ErrBusy, http.StatusServiceUnavailable},
+		{
+			"ErrConvoStorageFull",
+			ErrConvoStorageFull,
+			http.StatusInsufficientStorage,
+		},
+		{
+			"ErrServerStorageFull",
+			ErrServerStorageFull,
+			http.StatusInsufficientStorage,
+		},
+		{"ErrLongPath", ErrLongPath, http.StatusRequestURITooLong},
+		// these never reach a client unless something is wrong with the
+		// server
+		{"ErrNoUsers", ErrNoUsers, http.StatusInternalServerError},
+		{"ErrIdCollision", ErrIdCollision, http.StatusInternalServerError},
+		{
+			"something else",
+			errors.New("something else"),
+			http.StatusInternalServerError,
+		},
+	}
+
+	// find every exported error the package declares
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tested := map[string]bool{}
+	for _, test := range tests {
+		tested[test.name] = true
+	}
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range file.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				for _, ident := range spec.(*ast.ValueSpec).Names {
+					if strings.HasPrefix(ident.Name, "Err") &&
+						!tested[ident.Name] {
+						t.Errorf("%s (%s) isn't tested", ident.Name, name)
+					}
+				}
+			}
+		}
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		Error(w, httptest.NewRequest("GET", "/", nil), test.err)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+		body := strings.TrimSpace(w.Body.String())
+		if body != test.err.Error() {
+			t.Errorf("%s: got body %q", test.name, body)
+		}
+	}
+}
+
+func TestRoutePanic(t *testing.T) {
+	// without a room every conversation route panics
+	setGlobal(t, &Store, nil)
+
+	w := httptest.NewRecorder()
+	Route(w, httptest.NewRequest("GET", "/convoid", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestPutTooLarge(t *testing.T) {
+	setGlobal(t, &MaxMessageBytes, 16)
+	server := newTestServer(t)
+	convo := server.convo(t)
+
+	status, _ := convo.bob.text("PUT", "/"+convo.id, strings.Repeat("x", 17))
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d, want %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if count := messageCount(t, convo.id); count != 0 {
+		t.Fatalf("conversation has %d messages, want 0", count)
+	}
+
+	// a message that fits still goes through
+	convo.bob.put(convo.id, strings.Repeat("x", 16))
+	if count := messageCount(t, convo.id); count != 1 {
+		t.Fatalf("conversation has %d messages, want 1", count)
+	}
+}
+
+func TestRejoinReplay(t *testing.T) {
+	server := newTestServer(t)
+	alice := server.client(t, "10.0.0.1")
+	bob := server.client(t, "10.0.0.2")
+
+	aliceStream, convoId := alice.create()
+	// any Last-Event-ID gets the ids written
+	bobStream := bob.join(convoId, "Last-Event-ID", "0")
+	aliceStream.expect("> 10.0.0.2 ")
+	bobStream.expect("> 10.0.0.1 ")
+
+	first := alice.put(convoId, "first")
+	lastId := strings.TrimPrefix(bobStream.expect("id: "), "id: ")
+	bobStream.expect("+ 1 " + first)
+
+	bobStream.close()
+	aliceStream.expect("  1 " + first)
+	aliceStream.expect("< 10.0.0.2 ")
+	second := alice.put(convoId, "second")
+
+	// bob gets what they missed once, then what's waiting, then what's new
+	bobStream = bob.join(convoId, "Last-Event-ID", lastId)
+	bobStream.expect("> 10.0.0.1 ")
+	bobStream.expect("id: ")
+	bobStream.expect("+ 2 " + second)
+	bobStream.expect("* 2 unread: " + first + " " + second)
+
+	third := alice.put(convoId, "third")
+	bobStream.expect("id: ")
+	bobStream.expect("+ 3 " + third)
+}
+
+func TestBuildURL(t *testing.T) {
+	tests := []struct {
+		domain string
+		port   int
+		want   string
+	}{
+		{"localhost", 8080, "https://localhost:8080/"},
+		{"example.com", 443, "https://example.com/"},
+		{"example.com", 9000, "https://example.com:9000/"},
+	}
+
+	for _, test := range tests {
+		if url := BuildURL(test.domain, test.port); url != test.want {
+			t.Errorf(
+				"BuildURL(%q, %d) = %q, want %q",
+				test.domain, test.port, url, test.want,
+			)
+		}
+	}
+}
+
+func TestCreateLimits(t *testing.T) {
+	t.Run("room full", func(t *testing.T) {
+		setGlobal(t, &MaxConvos, 1)
+		server := newTestServer(t)
+		server.client(t, "10.0.0.1").create()
+
+		status, _ := server.client(t, "10.0.0.2").text("GET", "/", "")
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("got %d, want %d", status, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("too many per IP", func(t *testing.T) {
+		setGlobal(t, &MaxConvosPerIP, 1)
+		server := newTestServer(t)
+		alice := server.client(t, "10.0.0.1")
+		alice.create()
+
+		status, _ := alice.text("GET", "/", "")
+		if status != http.StatusTooManyRequests {
+			t.Fatalf("got %d, want %d", status, http.StatusTooManyRequests)
+		}
+
+		// someone else can still create one
+		server.client(t, "10.0.0.2").create()
+	})
+}
+
+func TestPutEmpty(t *testing.T) {
+	server := newTestServer(t)
+	convo := server.convo(t)
+
+	status, _ := convo.bob.text("PUT", "/"+convo.id, "")
+	if status != http.StatusBadRequest {
+		t.Fatalf("got %d, want %d", status, http.StatusBadRequest)
+	}
+	if count := messageCount(t, convo.id); count != 0 {
+		t.Fatalf("conversation has %d messages, want 0", count)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	server := newTestServer(t)
+	alice := server.client(t, "10.0.0.1")
+	_, convoId := alice.create()
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{"GET", "/a/b/c/d", http.StatusNotFound},
+		{"PUT", "/a/b/c/d", http.StatusNotFound},
+		{"DELETE", "/a/b/c/d", http.StatusNotFound},
+		{"PUT", "//", http.StatusNotFound},
+		{"DELETE", "//", http.StatusNotFound},
+		{"GET", "/" + convoId + "//status", http.StatusOK},
+		{"GET", "//" + convoId + "/status/", http.StatusOK},
+		{"GET", "/" + convoId + "//nothing", http.StatusNotFound},
+		{"GET", "/nothing//status", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		status, body := alice.text(test.method, test.path, "")
+		if status != test.want {
+			t.Errorf(
+				"%s %s: got %d %q, want %d",
+				test.method, test.path, status, body, test.want,
+			)
+		}
+	}
+
+	// doubled slashes are the same as one, so this creates a conversation
+	server.client(t, "10.0.0.2").stream("//").expect(": " + URL)
+}
+
+func TestCreateSaturated(t *testing.T) {
+	setGlobal(t, &MaxConvos, 10)
+	server := newTestServer(t)
+	setGlobal(t, &Creating, NewSemaphore(2))
+
+	// every slot is taken, so a create is turned away
+	Creating.Acquire()
+	Creating.Acquire()
+	status, _ := server.client(t, "10.0.0.1").text("GET", "/", "")
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	Creating.Release()
+	Creating.Release()
+
+	// a flood of slow creates, more than the room can hold
+	const count = 50
+	var (
+		wait     sync.WaitGroup
+		statuses = make(chan int, count)
+	)
+	for i := 0; i < count; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+
+			r, _ := http.NewRequest("GET", server.URL+"/", nil)
+			r.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.1.%d", i))
+			r.Header.Set(PASSWORD_HEADER, "password")
+			resp, err := server.Client().Do(r)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(i)
+	}
+	wait.Wait()
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			created++
+		case http.StatusServiceUnavailable:
+		default:
+			t.Fatalf(
+				"got %d, want %d or %d",
+				status, http.StatusOK, http.StatusServiceUnavailable,
+			)
+		}
+	}
+	if created == 0 || created > MaxConvos {
+		t.Fatalf("created %d conversations, want 1 to %d", created, MaxConvos)
+	}
+
+	// every slot was given back, whether the create worked or not
+	if len(Creating) != 0 {
+		t.Fatalf("%d slots are still taken", len(Creating))
+	}
+}
+
+func TestLongPath(t *testing.T) {
+	setGlobal(t, &MaxSegmentLength, 64)
+	server := newTestServer(t)
+	convo := server.convo(t)
+	long := strings.Repeat("a", 65)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/" + long},
+		{"PUT", "/" + long},
+		{"GET", "/" + convo.id + "/" + long},
+		{"DELETE", "/" + convo.id + "/" + long},
+	}
+
+	for _, test := range tests {
+		status, _ := convo.alice.text(test.method, test.path, "hello")
+		if status != http.StatusRequestURITooLong {
+			t.Errorf(
+				"%s with a %d character segment: got %d, want %d",
+				test.method, len(long), status, http.StatusRequestURITooLong,
+			)
+		}
+	}
+
+	// one character shorter is just a message that doesn't exist
+	status, _ := convo.alice.text("GET", "/"+convo.id+"/"+long[1:], "")
+	if status != http.StatusNotFound {
+		t.Fatalf("got %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestJoinRateLimited(t *testing.T) {
+	server := newTestServer(t)
+	_, convoId := server.client(t, "10.0.0.1").create(
+		PASSWORD_HEADER, "password",
+	)
+
+	mallory := server.client(t, "10.0.0.3")
+	guess := func(password string) int {
+		status, _ := mallory.text(
+			"GET", "/"+convoId, "",
+			PASSWORD_HEADER, password,
+		)
+		return status
+	}
+	for i := 0; i < DEFAULT_JOIN_BURST; i++ {
+		if status := guess("guess"); status != http.StatusForbidden {
+			t.Fatalf("guess %d: got %d, want 403", i, status)
+		}
+	}
+
+	// out of guesses, even the right password isn't checked
+	status := guess("password")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	// everyone else still gets their own guesses
+	bob := server.client(t, "10.0.0.2")
+	bob.join(convoId, PASSWORD_HEADER, "password").expect("> 10.0.0.1 ")
+
+	// and once they leave, their guesses aren't remembered
+	if status, _ := bob.text("DELETE", "/"+convoId, ""); status != 204 {
+		t.Fatalf("leave got %d, want 204", status)
+	}
+	JoinLimiter.Lock()
+	defer JoinLimiter.Unlock()
+	if _, ok := JoinLimiter.Buckets["10.0.0.2"]; ok {
+		t.Fatal("the join limiter still has a bucket for 10.0.0.2")
+	}
+}
+
+func TestPutBatchTooLarge(t *testing.T) {
+	server := newTestServer(t)
+	setGlobal(t, &PutLimiter, NewLimiter(1, 3))
+	convo := server.convo(t)
+
+	status, body := convo.bob.text(
+		"PUT", "/"+convo.id, "1\n2\n3\n4",
+		BATCH_HEADER, "true",
+	)
+	if status != http.StatusBadRequest || !strings.Contains(body, " 3 ") {
+		t.Fatalf("got %d %q, want 400 with the limit", status, body)
+	}
+	if count := messageCount(t, convo.id); count != 0 {
+		t.Fatalf("conversation has %d messages, want 0", count)
+	}
+
+	// a batch as big as the burst still goes through
+	status, body = convo.bob.text(
+		"PUT", "/"+convo.id, "1\n2\n3",
+		BATCH_HEADER, "true",
+	)
+	if status != http.StatusCreated {
+		t.Fatalf("got %d %q, want %d", status, body, http.StatusCreated)
+	}
+}
+
+func TestSelfJoin(t *testing.T) {
+	server := newTestServer(t)
+	alice := server.client(t, "10.0.0.1")
+	aliceStream, convoId := alice.create()
+
+	status, _ := alice.text("GET", "/"+convoId, "")
+	if status != http.StatusConflict {
+		t.Fatalf("got %d, want %d", status, http.StatusConflict)
+	}
+
+	// both slots can be one IP when it's allowed for testing
+	setGlobal(t, &AllowSameIP, true)
+	alice.join(convoId).expect("> 10.0.0.1 ")
+	aliceStream.expect("> 10.0.0.1 ")
+}
+
+func TestOptionsAllowHeaders(t *testing.T) {
+	server := newTestServer(t)
+	resp := server.client(t, "10.0.0.1").do("OPTIONS", "/", "")
+	resp.Body.Close()
+
+	allowed := resp.Header.Get("Access-Control-Allow-Headers")
+	for _, header := range []string{
+		TAG_HEADER,
+		PASSWORD_HEADER,
+		BATCH_HEADER,
+		PING_INTERVAL_HEADER,
+		NICK_HEADER,
+	} {
+		if !strings.Contains(allowed, header) {
+			t.Errorf("%s isn't allowed: %q", header, allowed)
+		}
+	}
+}
+
+// roomBytes returns how many bytes of messages the room holds.
+func roomBytes() int64 {
+	Store.Lock()
+	defer Store.Unlock()
+
+	return Store.Bytes
+}
+
+func TestMaxTotalBytes(t *testing.T) {
+	setGlobal(t, &MaxTotalBytes, 10)
+	setGlobal(t, &MessageTTL, time.Minute)
+	server := newTestServer(t)
+	clock := newFakeClock()
+	Store.Clock = clock
+	convo := server.convo(t)
+
+	// fill the server up
+	first := convo.alice.put(convo.id, "12345")
+	convo.alice.put(convo.id, "12345")
+	status, _ := convo.alice.text("PUT", "/"+convo.id, "1")
+	if status != http.StatusInsufficientStorage {
+		t.Fatalf("got %d, want %d", status, http.StatusInsufficientStorage)
+	}
+
+	// reading a message makes room for another
+	convo.bob.read(first)
+	if bytes := roomBytes(); bytes != 5 {
+		t.Fatalf("room holds %d bytes after a read, want 5", bytes)
+	}
+	third := convo.alice.put(convo.id, "12345")
+
+	// and so does cancelling one
+	path := strings.TrimPrefix(third, server.URL)
+	status, _ = convo.alice.text("DELETE", path, "")
+	if status != http.StatusNoContent {
+		t.Fatalf("cancel got %d, want %d", status, http.StatusNoContent)
+	}
+	if bytes := roomBytes(); bytes != 5 {
+		t.Fatalf("room holds %d bytes after a cancel, want 5", bytes)
+	}
+
+	// and so does a message expiring
+	clock.wait(t, 1)
+	clock.Advance(MessageTTL * 2)
+	deadline := time.Now().Add(STREAM_TIMEOUT)
+	for roomBytes() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("room holds %d bytes after expiry, want 0", roomBytes())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	convo.alice.put(convo.id, "1234567890")
+}
+
+func TestKickedRejoin(t *testing.T) {
+	server := newTestServer(t)
+	convo := server.convo(t)
+
+	status, _ := convo.alice.text("GET", "/"+convo.id+"/kick", "")
+	if status != http.StatusNoContent {
+		t.Fatalf("kick got %d, want %d", status, http.StatusNoContent)
+	}
+	convo.bobStream.ended()
+	convo.aliceStream.expect("< 10.0.0.2 ")
+
+	// bob can't take their old slot back
+	status, _ = convo.bob.text("GET", "/"+convo.id, "")
+	if status != http.StatusForbidden {
+		t.Fatalf("rejoin got %d, want %d", status, http.StatusForbidden)
+	}
+
+	// but someone else can have it
+	server.client(t, "10.0.0.3").join(convo.id).expect("> 10.0.0.1 ")
+	convo.aliceStream.expect("> 10.0.0.3 ")
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	server := newTestServer(t)
+	client := server.client(t, "10.0.0.1")
+
+	for _, method := range []string{"POST", "PATCH"} {
+		resp := client.do(method, "/", "hello")
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf(
+				"%s got %d, want %d",
+				method, resp.StatusCode, http.StatusMethodNotAllowed,
+			)
+		}
+		if allow := resp.Header.Get("Allow"); allow != ALLOWED_METHODS {
+			t.Errorf("%s got Allow %q, want %q", method, allow, ALLOWED_METHODS)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		basePath string
+		uri      string
+		want     string
+	}{
+		{"", "/", "https://example.com/"},
+		{"", "/abc", "https://example.com/abc"},
+		{"", "/abc/status?raw", "https://example.com/abc/status?raw"},
+		{"/convo", "/convo", "https://example.com/convo/"},
+		{"/convo", "/convo/", "https://example.com/convo/"},
+		{"/convo", "/convo?raw", "https://example.com/convo/?raw"},
+		{"/convo", "/convo/abc", "https://example.com/convo/abc"},
+		{"/convo", "/convo/abc/status", "https://example.com/convo/abc/status"},
+		{"/convo", "/convos/abc", "https://example.com/convo/convos/abc"},
+	}
+
+	for _, test := range tests {
+		setGlobal(t, &BasePath, test.basePath)
+		setGlobal(t, &URL, "https://example.com"+test.basePath+"/")
+
+		w := httptest.NewRecorder()
+		Redirect(w, httptest.NewRequest("GET", test.uri, nil))
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: got %d, want 301", test.uri, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.want {
+			t.Errorf(
+				"%s with base path %q: got %q, want %q",
+				test.uri, test.basePath, location, test.want,
+			)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	setGlobal(t, &BasePath, "/chat")
+	server := newTestServer(t)
+	if want := server.URL + "/chat/"; URL != want {
+		t.Fatalf("URL is %q, want %q", URL, want)
+	}
+
+	// creating checks the link has the BasePath in it, and joining only
+	// works under it
+	convo := server.convo(t)
+
+	url := convo.bob.put(convo.id, "hello")
+	if want := server.URL + "/chat/" + convo.id + "/"; !strings.HasPrefix(
+		url,
+		want,
+	) {
+		t.Fatalf("message url %q doesn't start with %q", url, want)
+	}
+	convo.aliceStream.expect("+ 1 " + url)
+	convo.bobStream.expect("  1 " + url)
+
+	if message := convo.alice.read(url); message != "hello" {
+		t.Fatalf("read %q, want %q", message, "hello")
+	}
+	convo.bobStream.expect("- " + url + " 10.0.0.1 ")
+
+	// the routes that hand the link back out use the BasePath too
+	for _, path := range []string{"/" + convo.id + "/link", "/list"} {
+		status, body := convo.alice.text("GET", path, "")
+		if status != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, status, body)
+		}
+		if want := URL + convo.id + "\n"; body != want {
+			t.Fatalf("GET %s: got %q, want %q", path, body, want)
+		}
+	}
+
+	// nothing exists outside of the BasePath
+	for _, path := range []string{
+		"/",
+		"/" + convo.id,
+		"/chatter",
+		"/chatter/" + convo.id,
+	} {
+		resp, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf(
+				"GET %s: got %d, want %d",
+				path,
+				resp.StatusCode,
+				http.StatusNotFound,
+			)
+		}
+	}
+}
+
+func TestIdCase(t *testing.T) {
+	for _, alphabet := range []string{
+		"abcdefghijklmnopqrstuvwxyz",
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	} {
+		t.Run(alphabet[:1], func(t *testing.T) {
+			setGlobal(t, &IdAlphabet, alphabet)
+			server := newTestServer(t)
+			alice := server.client(t, "10.0.0.1")
+			_, convoId := alice.create()
+
+			// the id and the route name can be typed in either case
+			for _, path := range []string{
+				"/" + strings.ToLower(convoId) + "/status",
+				"/" + strings.ToUpper(convoId) + "/STATUS",
+				"/" + convoId + "/Status",
+			} {
+				status, body := alice.text("GET", path, "")
+				if status != http.StatusOK {
+					t.Errorf("%s: got %d %q", path, status, body)
+				}
+			}
+		})
+	}
+}
+
+func TestReadRateLimited(t *testing.T) {
+	server := newTestServer(t)
+	setGlobal(t, &ReadLimiter, NewLimiter(1, 2))
+	convo := server.convo(t)
+	path := "/" + convo.id + "/nothing"
+
+	// guessing at messages of a conversation you're not in still counts
+	mallory := server.client(t, "10.0.0.3")
+	for _, want := range []int{
+		http.StatusForbidden,
+		http.StatusForbidden,
+		http.StatusTooManyRequests,
+	} {
+		if status, _ := mallory.text("GET", path, ""); status != want {
+			t.Fatalf("got %d, want %d", status, want)
+		}
+	}
+
+	// everyone else has their own limit
+	if status, _ := convo.bob.text("GET", path, ""); status != http.StatusNotFound {
+		t.Fatalf("got %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestHistoryEvicted(t *testing.T) {
+	setGlobal(t, &KeepHistory, true)
+	setGlobal(t, &MaxConvoMessages, 3)
+	server := newTestServer(t)
+	setGlobal(t, &PutLimiter, NewLimiter(0, 0))
+	setGlobal(t, &ReadLimiter, NewLimiter(0, 0))
+	convo := server.convo(t)
+
+	first := convo.alice.put(convo.id, "0")
+	convo.bob.read(first)
+	for i := 1; i < 10; i++ {
+		convo.bob.read(convo.alice.put(convo.id, fmt.Sprint(i)))
+		if count := messageCount(t, convo.id); count > 3 {
+			t.Fatalf("conversation has %d messages, want at most 3", count)
+		}
+	}
+
+	// the oldest read messages made room for the new ones
+	status, _ := convo.bob.text(
+		"GET",
+		strings.TrimPrefix(first, server.URL),
+		"",
+	)
+	if status != http.StatusNotFound {
+		t.Fatalf("got %d, want %d", status, http.StatusNotFound)
+	}
+
+	// unread messages still can't be evicted
+	for i := 0; i < 3; i++ {
+		convo.alice.put(convo.id, "unread")
+	}
+	status, _ = convo.alice.text("PUT", "/"+convo.id, "full")
+	if status != http.StatusInsufficientStorage {
+		t.Fatalf("got %d, want %d", status, http.StatusInsufficientStorage)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"time"
+)
+
+const (
+	// TAG_HEADER is the header a message's integrity tag is sent and returned
+	// in
+	TAG_HEADER = "X-Message-Tag"
+	// MAX_TAG_LENGTH is the longest tag that can be stored, plenty for a hex
+	// or base64 HMAC
+	MAX_TAG_LENGTH = 256
+	// BATCH_HEADER is the header that's set to "true" when a PUT is a batch
+	// of messages, one on each line
+	BATCH_HEADER = "X-Convo-Batch"
+	// DEFAULT_CONTENT_TYPE is what a message is read as when the sender
+	// didn't say what it is
+	DEFAULT_CONTENT_TYPE = "application/octet-stream"
+)
+
+var (
+	// ErrBadTag is returned when a message's tag is too long or isn't
+	// printable.
+	ErrBadTag = errors.New("message tag is too long or has invalid characters")
+	// ErrEmptyMessage is returned when a message has no data, there would be
+	// nothing for the recipient to read.
+	ErrEmptyMessage = errors.New("message is empty")
+	// ErrBadContentType is returned when a message's Content-Type can't be
+	// parsed.
+	ErrBadContentType = errors.New("message content type is invalid")
+	// ErrBatchTag is returned when a batch of messages has a tag, there's
+	// only one tag and no way to tell which message it's for.
+	ErrBatchTag = errors.New("a batch of messages can't have a tag")
+	// ErrBatchTooLarge is returned when a batch has more messages than can
+	// be sent at once, the rate limit would turn it away every time.
+	ErrBatchTooLarge = errors.New("too many messages in the batch")
+)
+
+// Message is a single unread message in a conversation.
+type Message struct {
+	// Seq is the position of the message in its conversation, so messages
+	// can be put in order even though messageIds are random
+	Seq uint64
+	// Data is the raw content of the message
+	Data []byte
+	// From is the IP of the user who sent the message
+	From string
+	// Tag is an integrity tag (like an HMAC) from the sender, the server
+	// never checks it, it's just returned to the recipient so they can
+	Tag string `json:",omitempty"`
+	// ContentType is the media type the sender gave the message, it's
+	// returned to the recipient so the message can be shown properly
+	ContentType string `json:",omitempty"`
+	// Expires is when the message is deleted if no one has read it
+	Expires time.Time
+	// Read is whether or not the recipient has read the message, read
+	// messages are only kept if KeepHistory is set
+	Read bool `json:",omitempty"`
+}
+
+// NewMessage creates a new message with data, tag and contentType sent from
+// ip at now that expires after ttl. A ttl of zero means the message never
+// expires.
+func NewMessage(
+	data []byte,
+	tag, contentType, ip string,
+	now time.Time,
+	ttl time.Duration,
+) *Message {
+	message := &Message{
+		Data:        data,
+		From:        ip,
+		Tag:         tag,
+		ContentType: contentType,
+	}
+
+	if ttl > 0 {
+		message.Expires = now.Add(ttl)
+	}
+
+	return message
+}
+
+// CheckTag makes sure a tag can be stored and safely returned in a header.
+func CheckTag(tag string) error {
+	if len(tag) > MAX_TAG_LENGTH {
+		return ErrBadTag
+	}
+
+	for i := 0; i < len(tag); i++ {
+		if tag[i] < '!' || tag[i] > '~' {
+			return ErrBadTag
+		}
+	}
+
+	return nil
+}
+
+// CheckContentType cleans up the Content-Type a message was sent with so it
+// can be safely returned in a header. An empty one is left empty.
+func CheckContentType(contentType string) (string, error) {
+	// curl sends this with every -d, whether or not it's what the data is,
+	// so it doesn't say anything about the message
+	if contentType == "" ||
+		contentType == "application/x-www-form-urlencoded" {
+		return "", nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", ErrBadContentType
+	}
+
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// SplitBatch splits the body of a batch into its messages, one on each line.
+// Blank lines are skipped, there's nothing in them to send.
+func SplitBatch(data []byte) [][]byte {
+	messages := make([][]byte, 0)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) > 0 {
+			messages = append(messages, line)
+		}
+	}
+
+	return messages
+}
+
+// Expired determines whether or not the message has outlived its ttl by now.
+// Only unread messages expire, read ones are part of the history.
+func (m *Message) Expired(now time.Time) bool {
+	return !m.Read && !m.Expires.IsZero() && now.After(m.Expires)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// Metrics counts events over the lifetime of the server. The fields are
+// updated with sync/atomic so they don't need the room lock.
+type Metrics struct {
+	// ConvosCreated is the number of conversations created
+	ConvosCreated uint64
+	// ConvosDeleted is the number of conversations deleted
+	ConvosDeleted uint64
+	// MessagesCreated is the number of messages added to conversations
+	MessagesCreated uint64
+	// MessagesRead is the number of messages read from conversations
+	MessagesRead uint64
+}
+
+// Stats is the global set of counters exposed on /metrics.
+var Stats = &Metrics{}
+
+var (
+	// helpEscaper escapes the text of a # HELP line, where a newline would
+	// end the line early
+	helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	// labelEscaper escapes a label value, which is also quoted
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Labels formats labels, which alternate between name and value, as the
+// {name="value",...} part of a sample line, or nothing if there are none.
+// The values are escaped so they can't break out of their quotes.
+func Labels(labels ...string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(
+			pairs,
+			labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`,
+		)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add increments one of the counters by one.
+func (m *Metrics) Add(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// ServeHTTP writes the gauges and counters in the Prometheus text format, so
+// the server can be scraped without pulling in the client library.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		// metric writes a single metric with its help and type lines, and
+		// labels that alternate between name and value
+		metric = func(
+			name, kind, help string,
+			value uint64,
+			labels ...string,
+		) {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+			fmt.Fprintf(w, "%s%s %d\n", name, Labels(labels...), value)
+		}
+	)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric(
+		"convospace_build_info",
+		"gauge",
+		"Always 1, labeled with the Go version the server was built with.",
+		1,
+		"go_version", runtime.Version(),
+	)
+	metric(
+		"convospace_convos_active",
+		"gauge",
+		"Number of active conversations.",
+		uint64(Store.Count()),
+	)
+	metric(
+		"convospace_users_connected",
+		"gauge",
+		"Number of users connected to a conversation.",
+		uint64(Store.UserCount()),
+	)
+	metric(
+		"convospace_convos_created_total",
+		"counter",
+		"Number of conversations created.",
+		atomic.LoadUint64(&m.ConvosCreated),
+	)
+	metric(
+		"convospace_convos_deleted_total",
+		"counter",
+		"Number of conversations deleted.",
+		atomic.LoadUint64(&m.ConvosDeleted),
+	)
+	metric(
+		"convospace_messages_created_total",
+		"counter",
+		"Number of messages sent.",
+		atomic.LoadUint64(&m.MessagesCreated),
+	)
+	metric(
+		"convospace_messages_read_total",
+		"counter",
+		"Number of messages read.",
+		atomic.LoadUint64(&m.MessagesRead),
+	)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseSample splits a sample line of the Prometheus text format into its
+// name, unescaped labels and value, failing the test if it's malformed.
+func parseSample(
+	t *testing.T,
+	line string,
+) (string, map[string]string, string) {
+	t.Helper()
+
+	labels := map[string]string{}
+	name, rest, ok := strings.Cut(line, "{")
+	if !ok {
+		name, rest, _ = strings.Cut(line, " ")
+		return name, labels, rest
+	}
+
+	for {
+		label, value, ok := strings.Cut(rest, `="`)
+		if !ok {
+			t.Fatalf("%q: label without a value", line)
+		}
+
+		// read the quoted value up to the first unescaped quote
+		var unescaped strings.Builder
+		i := 0
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] != '\\' {
+				unescaped.WriteByte(value[i])
+				continue
+			}
+			if i++; i == len(value) {
+				break
+			}
+			switch value[i] {
+			case '\\', '"':
+				unescaped.WriteByte(value[i])
+			case 'n':
+				unescaped.WriteByte('\n')
+			default:
+				t.Fatalf("%q: bad escape \\%c", line, value[i])
+			}
+		}
+		if i >= len(value) {
+			t.Fatalf("%q: unterminated label value", line)
+		}
+		labels[label] = unescaped.String()
+
+		rest = value[i+1:]
+		if strings.HasPrefix(rest, "} ") {
+			return name, labels, rest[2:]
+		}
+		if rest, ok = strings.CutPrefix(rest, ","); !ok {
+			t.Fatalf("%q: expected , or } after a label", line)
+		}
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	newTestServer(t)
+
+	w := httptest.NewRecorder()
+	Stats.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	var (
+		help    = map[string]bool{}
+		kinds   = map[string]string{}
+		samples = map[string]map[string]string{}
+	)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			help[fields[2]] = true
+		case strings.HasPrefix(line, "# TYPE "):
+			if len(fields) != 4 ||
+				(fields[3] != "counter" && fields[3] != "gauge") {
+				t.Fatalf("bad type line %q", line)
+			}
+			kinds[fields[2]] = fields[3]
+		default:
+			name, labels, value := parseSample(t, line)
+			// each sample comes after the lines describing it
+			if !help[name] || kinds[name] == "" {
+				t.Errorf("%s has no # HELP or # TYPE before it", name)
+			}
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				t.Errorf("%s: bad value %q", name, value)
+			}
+			if kinds[name] == "counter" &&
+				!strings.HasSuffix(name, "_total") {
+				t.Errorf("counter %s doesn't end in _total", name)
+			}
+			samples[name] = labels
+		}
+	}
+
+	for _, name := range []string{
+		"convospace_build_info",
+		"convospace_convos_active",
+		"convospace_users_connected",
+		"convospace_convos_created_total",
+		"convospace_convos_deleted_total",
+		"convospace_messages_created_total",
+		"convospace_messages_read_total",
+	} {
+		if _, ok := samples[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	if samples["convospace_build_info"]["go_version"] == "" {
+		t.Error("convospace_build_info has no go_version")
+	}
+}
+
+func TestLabelsEscaped(t *testing.T) {
+	value := "a \"quoted\" \\ value\non two lines"
+	line := "test" + Labels("name", value, "other", "") + " 1"
+
+	if strings.Contains(line, "\n") {
+		t.Fatalf("%q spans more than one line", line)
+	}
+	name, labels, _ := parseSample(t, line)
+	if name != "test" || labels["name"] != value || labels["other"] != "" {
+		t.Fatalf("%q parsed as %s %q", line, name, labels)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+const (
+	// PASSWORD_HEADER is the header the join password is sent in, both when
+	// creating a conversation and when joining one
+	PASSWORD_HEADER = "X-Convo-Password"
+
+	// how the join passwords are hashed
+	PASSWORD_SALT_BYTES = 16
+	PASSWORD_HASH_BYTES = 32
+	PASSWORD_ITERATIONS = 100000
+)
+
+// ErrWrongPassword is returned when someone joins a conversation that has a
+// password without the right one.
+var ErrWrongPassword = errors.New("wrong or missing password")
+
+// Password is the hash of a conversation's join password. The password itself
+// is never kept.
+type Password struct {
+	Salt []byte
+	Hash []byte
+}
+
+// NewPassword hashes password with a new random salt.
+func NewPassword(password string) (*Password, error) {
+	var (
+		p   = &Password{Salt: make([]byte, PASSWORD_SALT_BYTES)}
+		err error
+	)
+
+	if _, err = rand.Read(p.Salt); err != nil {
+		return nil, err
+	}
+
+	if p.Hash, err = p.hash(password); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Check determines whether or not password is the one that was hashed. A nil
+// Password means the conversation doesn't have one, so anything goes.
+func (p *Password) Check(password string) bool {
+	if p == nil {
+		return true
+	}
+
+	hash, err := p.hash(password)
+	if err != nil {
+		return false
+	}
+
+	// compare in constant time so the hash can't be guessed a byte at a time
+	return subtle.ConstantTimeCompare(hash, p.Hash) == 1
+}
+
+// hash hashes password with the salt. It's slow on purpose, so a stolen state
+// file can't be used to guess passwords quickly.
+func (p *Password) hash(password string) ([]byte, error) {
+	return pbkdf2.Key(
+		sha256.New,
+		password,
+		p.Salt,
+		PASSWORD_ITERATIONS,
+		PASSWORD_HASH_BYTES,
+	)
+}
@@ -2,8 +2,45 @@ package main
 
 import (
 	"errors"
-	"fmt"
+	"log/slog"
+	"sort"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrConvoGone is returned when a conversation is deleted between
+	// checking that it exists and acting on it.
+	ErrConvoGone = errors.New("conversation doesn't exist")
+	// ErrConvoFull is returned when both slots of a conversation are taken.
+	ErrConvoFull = errors.New("conversation is full")
+	// ErrNoMessage is returned when a message doesn't exist, usually because
+	// it was already read.
+	ErrNoMessage = errors.New("message doesn't exist")
+	// ErrNotParticipant is returned when someone who isn't in a conversation
+	// tries to read or write its messages.
+	ErrNotParticipant = errors.New("not a participant of this conversation")
+	// ErrNotSender is returned when someone tries to cancel a message they
+	// didn't send.
+	ErrNotSender = errors.New("only the sender can cancel a message")
+	// ErrRoomFull is returned when there are already as many conversations as
+	// the server allows.
+	ErrRoomFull = errors.New("too many conversations, try again later")
+	// ErrTooManyConvos is returned when someone creating a conversation is
+	// already in as many conversations as one IP is allowed.
+	ErrTooManyConvos = errors.New("you're in too many conversations")
+	// ErrSameIP is returned when someone tries to join a conversation they're
+	// already in from the same IP.
+	ErrSameIP = errors.New("you're already in this conversation")
+	// ErrNotCreator is returned when someone other than the creator of a
+	// conversation tries to do something only the creator can.
+	ErrNotCreator = errors.New("only the creator of this conversation can")
+	// ErrNoPeer is returned when the creator tries to kick the other user
+	// and there isn't one.
+	ErrNoPeer = errors.New("no one else is in this conversation")
+	// ErrKicked is returned when someone the creator kicked out tries to
+	// join again.
+	ErrKicked = errors.New("you were kicked from this conversation")
 )
 
 // Room contains multiple conversations and a mutex for safety.
@@ -11,6 +48,87 @@ type Room struct {
 	sync.Mutex
 	// Convos is a map of all active conversations where the key is convoId
 	Convos map[string]*Convo
+	// Clock is given to each new conversation to tell the time with
+	Clock Clock
+	// Bytes is the total size of the messages held by every conversation,
+	// read or not
+	Bytes int64
+	// done is closed when the room is closed, to stop the Ping goroutine
+	done chan struct{}
+}
+
+// NewRoom creates an empty room that tells the time with clock.
+func NewRoom(clock Clock) *Room {
+	return &Room{
+		Convos: make(map[string]*Convo, 0),
+		Clock:  clock,
+		done:   make(chan struct{}),
+	}
+}
+
+// unlock releases the lock, then writes the events queued in the
+// conversation's outbox while it was held and ends the streams of the users
+// that were removed. Nothing is written to a user while the room is locked, so
+// one slow user can't hold up every other conversation.
+func (r *Room) unlock(convo *Convo) {
+	var (
+		outbox []Delivery = convo.Outbox
+		ending []*User    = convo.Ending
+	)
+	convo.Outbox, convo.Ending = nil, nil
+
+	// take the delivering lock before releasing the room, so the next
+	// outbox of this conversation can't be written before this one
+	convo.Delivering.Lock()
+	defer convo.Delivering.Unlock()
+	r.Unlock()
+
+	deliver(outbox, ending)
+}
+
+// deliver writes each event in outbox to its user, then ends the streams of
+// the users in ending.
+func deliver(outbox []Delivery, ending []*User) {
+	for _, delivery := range outbox {
+		delivery.User.Write(delivery.Event)
+	}
+	for _, user := range ending {
+		close(user.Stop)
+	}
+}
+
+// Close ends every conversation, telling the users the server is shutting
+// down before their streams end, and stops the Ping goroutine. Calling it
+// again does nothing, since there are no conversations left to end.
+func (r *Room) Close() {
+	var (
+		outbox []Delivery
+		ending []*User
+	)
+
+	r.Lock()
+	// stop pinging, unless that already happened
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	for convoId, convo := range r.Convos {
+		// the conversation is going now, not when the timer fires
+		if convo.Teardown != nil {
+			convo.Teardown.Stop()
+			convo.Teardown = nil
+		}
+
+		r.endConvo(convoId, "server shutting down")
+
+		outbox = append(outbox, convo.Outbox...)
+		ending = append(ending, convo.Ending...)
+		convo.Outbox, convo.Ending = nil, nil
+	}
+	r.Unlock()
+
+	deliver(outbox, ending)
 }
 
 // IPExists determines whether or not one of the users in the conversation has
@@ -20,6 +138,11 @@ func (r *Room) IPExists(convoId, ip string) bool {
 	r.Lock()
 	defer r.Unlock()
 
+	// nobody is in a conversation that doesn't exist
+	if _, ok := r.Convos[convoId]; !ok {
+		return false
+	}
+
 	if r.Convos[convoId].Users[0] != nil &&
 		r.Convos[convoId].Users[0].IP == ip {
 		return true
@@ -31,161 +154,1101 @@ func (r *Room) IPExists(convoId, ip string) bool {
 	return false
 }
 
-// OtherUser returns a notification of the other user's IP in a conversation.
-// This is used when a user is joining a conversation with someone else already
-// waiting for them. This way you can know the IP of who's on the other side
-// even if you weren't there to see them join (and read the join notification).
-func (r *Room) OtherUser(convoId string, userId int) []byte {
+// UserByIP returns the user in a conversation with the ip passed as a
+// parameter, or nil if there isn't one.
+func (r *Room) UserByIP(convoId, ip string) *User {
 	r.Lock()
 	defer r.Unlock()
 
-	// return the notification message with the other user's ip
-	return []byte(fmt.Sprintf(
-		"> %s",
-		r.Convos[convoId].Users[OtherUserId(userId)].IP),
-	)
+	if _, ok := r.Convos[convoId]; !ok {
+		return nil
+	}
+
+	for _, user := range r.Convos[convoId].Users {
+		if user != nil && user.IP == ip {
+			return user
+		}
+	}
+
+	return nil
 }
 
-// DeleteUser removes the user from a conversation and deletes the user.
-func (r *Room) DeleteUser(convoId string, userId int) {
+// Peer returns the user in a conversation who isn't its creator, so the
+// creator can kick them. It returns ErrNotCreator if ip isn't the creator's,
+// and ErrNoPeer if no one else is connected.
+func (r *Room) Peer(convoId, ip string) (*User, error) {
 	r.Lock()
 	defer r.Unlock()
 
-	// get the user ip for the quit message later
-	ip := r.Convos[convoId].Users[userId].IP
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		return nil, ErrConvoGone
+	}
+	if convo.Creator != ip {
+		return nil, ErrNotCreator
+	}
+
+	for _, user := range convo.Users {
+		if user != nil && user.IP != ip {
+			return user, nil
+		}
+	}
+
+	return nil, ErrNoPeer
+}
+
+// hasIP determines whether or not any conversation has a user with the ip
+// passed as a parameter. The caller must hold the lock.
+func (r *Room) hasIP(ip string) bool {
+	for _, convo := range r.Convos {
+		for _, user := range convo.Users {
+			if user != nil && user.IP == ip {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// countIP returns how many conversations have a user with the ip passed as a
+// parameter. The caller must hold the lock.
+func (r *Room) countIP(ip string) int {
+	count := 0
+	for _, convo := range r.Convos {
+		for _, user := range convo.Users {
+			if user != nil && user.IP == ip {
+				count++
+				break
+			}
+		}
+	}
+
+	return count
+}
+
+// DeleteUser removes the user from its conversation and deletes the user,
+// telling the other user the reason (one of the LEAVE_ reasons). It returns
+// false if the user was already removed, so it's safe to call from both the
+// DELETE handler and the closed connection cleanup.
+func (r *Room) DeleteUser(user *User, reason string) bool {
+	// lock before looking at the user, a queued user's slot is only set
+	// while holding the lock
+	r.Lock()
+
+	var (
+		convoId string = user.ConvoId
+		userId  int    = user.UserId
+	)
+
+	// a user waiting for a slot just leaves the queue
+	if user.Queued {
+		defer r.Unlock()
+		return r.unqueue(user)
+	}
+
+	// make sure the user is still in the conversation, the slot might be
+	// empty or already taken by someone else
+	convo, ok := r.Convos[convoId]
+	if !ok || convo.Users[userId] != user {
+		r.Unlock()
+		return false
+	}
+	defer r.unlock(convo)
+
+	// get the user ip and name for the quit message later
+	ip := user.IP
+	name := user.Name()
+
+	slog.Info("user left", "convoId", convoId, "ip", ip, "reason", reason)
 
 	// delete the user from the conversation
 	r.Convos[convoId].Users[userId] = nil
 
+	// someone who was kicked would otherwise just come back to their old
+	// slot, so they're kept out from now on
+	if reason == LEAVE_KICKED {
+		convo.Kicked[ip] = true
+	}
+
+	// if the user's ip isn't in any other conversation, it can't send any
+	// more messages so its rate limit doesn't need to be remembered
+	if !r.hasIP(ip) {
+		PutLimiter.Forget(ip)
+		TypingLimiter.Forget(ip)
+		ReadLimiter.Forget(ip)
+		JoinLimiter.Forget(ip)
+	}
+
+	// send the user leaving notification to the remaining user, and give
+	// the slot to whoever has waited the longest
+	if len(convo.Queue) > 0 {
+		convo.Send(OtherUserId(userId), Event{
+			Type: EVENT_LEAVE,
+			From: name,
+			Time: Timestamp(convo.Clock.Now()),
+			Text: reason,
+		})
+		r.promote(convo, userId)
+		return true
+	}
+
 	// if this user is the last one leaving a conversation, also end the
-	// conversation and delete it
+	// conversation and delete it, after giving them a chance to reconnect
 	if r.Convos[convoId].Users[0] == nil &&
 		r.Convos[convoId].Users[1] == nil {
+		if ReconnectGrace > 0 {
+			convo.Teardown = convo.Clock.AfterFunc(ReconnectGrace, func() {
+				r.teardown(convo)
+			})
+			return true
+		}
+
+		r.deleteConvo(convoId)
+
+		return true
+	}
+
+	// send the user leaving notification to the remaining user
+	r.Convos[convoId].Send(
+		OtherUserId(userId),
+		Event{
+			Type: EVENT_LEAVE,
+			From: name,
+			Time: Timestamp(convo.Clock.Now()),
+			Text: reason,
+		},
+	)
+
+	return true
+}
+
+// deleteConvo stops and deletes a conversation that has no users left. The
+// caller must hold the lock.
+func (r *Room) deleteConvo(convoId string) {
+	slog.Info("convo deleted", "convoId", convoId)
+	r.Convos[convoId].LogSummary()
+	Hooks.Notify(HOOK_DELETED, r.Convos[convoId])
+
+	// stop the expiring and join services, and removing it from the room
+	// stops the pinging
+	close(r.Convos[convoId].Stop)
+	r.Convos[convoId].Release()
+	// remove the conversation from the room
+	delete(r.Convos, convoId)
+	Stats.Add(&Stats.ConvosDeleted)
+}
+
+// teardown deletes a conversation once the last user has had ReconnectGrace
+// to come back, unless someone did.
+func (r *Room) teardown(convo *Convo) {
+	r.Lock()
+	defer r.Unlock()
+
+	// the conversation might have ended some other way, or someone might
+	// have rejoined just as the timer fired
+	if r.Convos[convo.ConvoId] != convo ||
+		convo.Users[0] != nil || convo.Users[1] != nil {
+		return
+	}
+
+	r.deleteConvo(convo.ConvoId)
+}
+
+// unqueue removes a user from the queue of its conversation. It returns false
+// if the user isn't in the queue. The caller must hold the lock.
+func (r *Room) unqueue(user *User) bool {
+	convo, ok := r.Convos[user.ConvoId]
+	if !ok {
+		return false
+	}
+
+	for i, queued := range convo.Queue {
+		if queued == user {
+			convo.Queue = append(convo.Queue[:i], convo.Queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// promote moves the first user in the queue of a conversation into the empty
+// slot with userId, the same as if they had just joined. The caller must hold
+// the lock.
+func (r *Room) promote(convo *Convo, userId int) {
+	user := convo.Queue[0]
+	convo.Queue = convo.Queue[1:]
+
+	user.Queued = false
+	user.UserId = userId
+	user.Joined = convo.Clock.Now()
+
+	// someone new in the slot has nothing to catch up on from whoever was
+	// there before
+	if convo.LastIPs[userId] != user.IP {
+		convo.Backlog[userId] = nil
+	}
+
+	// tell the other user that someone joined
+	convo.Send(OtherUserId(userId), Event{
+		Type: EVENT_JOIN,
+		From: user.Name(),
+		Time: Timestamp(user.Joined),
+	})
+	convo.Users[userId] = user
+	convo.LastIPs[userId] = user.IP
+
+	// tell the new user that they're in, and who's on the other side
+	convo.Outbox = append(convo.Outbox, Delivery{
+		User:  user,
+		Event: Event{Type: EVENT_NOTICE, Text: "a slot opened, you joined"},
+	})
+	r.welcome(convo, user)
+
+	slog.Info(
+		"user joined from queue",
+		"convoId", convo.ConvoId,
+		"ip", user.IP,
+	)
+	Hooks.Notify(HOOK_JOINED, convo)
+}
+
+// welcome queues what a user who just got a slot in the conversation needs to
+// know: who's on the other side, everything they missed since the event they
+// last saw if they're reconnecting, and the messages waiting for them. The
+// caller must hold the lock.
+func (r *Room) welcome(convo *Convo, user *User) {
+	// the other slot is empty if the conversation was restored from the
+	// state file
+	if other := convo.Users[OtherUserId(user.UserId)]; other != nil {
+		convo.Outbox = append(convo.Outbox, Delivery{
+			User: user,
+			Event: Event{
+				Type: EVENT_JOIN,
+				From: other.Name(),
+				Time: Timestamp(other.Joined),
+			},
+		})
+	}
+
+	if lastId, ok := user.LastEventId(); ok {
+		for _, event := range convo.Replay(user.UserId, lastId) {
+			convo.Outbox = append(convo.Outbox, Delivery{user, event})
+		}
+	}
+
+	// let the user know what's still waiting to be read, whether or not
+	// they saw it arrive
+	if pending := convo.Pending(user.IP); pending != nil {
+		convo.Outbox = append(convo.Outbox, Delivery{user, *pending})
+	}
+}
+
+// ReadMessage returns the message with messageId without changing anything,
+// so it can be written out before it's gone. FinishRead has to be called once
+// the reader has all of it.
+func (r *Room) ReadMessage(convoId, messageId string) (*Message, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// the conversation might have been deleted since the caller checked
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		return nil, ErrConvoGone
+	}
+
+	// check if the message exists
+	message := convo.ReadMessage(messageId)
+	if message == nil {
+		return nil, ErrNoMessage
+	}
+
+	convo.LastActivity = convo.Clock.Now()
+
+	return message, nil
+}
+
+// FinishRead deletes the message with messageId from the conversation (or
+// marks it read if KeepHistory is set) after the user with ip has read all of
+// it. The read notification says who read the message (by ip) and when. The
+// sender reading their own message doesn't delete it, so it's still there for
+// the recipient, and doesn't send a read notification, which would look like
+// the recipient had read it.
+func (r *Room) FinishRead(convoId, messageId, ip string) error {
+	r.Lock()
+
+	// the conversation might have been deleted while the message was being
+	// read
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return ErrConvoGone
+	}
+	defer r.unlock(convo)
 
-		println("deleting " + convoId)
+	// the message might have expired while it was being read, but the reader
+	// still got it, so only a message that's gone is missing
+	message, ok := convo.Messages[messageId]
+	if !ok {
+		return ErrNoMessage
+	}
+
+	// delete the message, it can only be read once by the recipient unless
+	// it's being kept in the history
+	if message.From != ip && !message.Read {
+		if KeepHistory {
+			convo.MarkRead(messageId)
+		} else {
+			convo.DeleteMessage(messageId)
+		}
+		Stats.Add(&Stats.MessagesRead)
+	}
+	slog.Debug(
+		"message read",
+		"convoId", convoId,
+		"messageId", messageId,
+		"ip", ip,
+	)
+
+	// the sender reading their own message isn't news to anyone
+	if message.From == ip {
+		return nil
+	}
+
+	// broadcast that the message was read, the reader already has the
+	// message so no one connected to hear about it isn't their problem
+	if err := convo.Broadcast(Event{
+		Type: EVENT_READ,
+		URL:  URL + convoId + "/" + messageId,
+		From: convo.Name(ip),
+		Time: Timestamp(convo.Clock.Now()),
+	}); errors.Is(err, ErrNoUsers) {
+		slog.Debug(
+			"read notification not delivered, no users connected",
+			"convoId", convoId,
+			"messageId", messageId,
+		)
+	}
+
+	return nil
+}
+
+// CancelMessage deletes an unread message from the conversation on behalf of
+// its sender, and broadcasts that it's gone. It returns ErrNotSender if ip
+// didn't send the message.
+func (r *Room) CancelMessage(convoId, messageId, ip string) error {
+	r.Lock()
+
+	// the conversation might have been deleted since the caller checked
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return ErrConvoGone
+	}
+	defer r.unlock(convo)
+
+	// the message might have been read or expired already, read messages
+	// kept in the history can't be taken back
+	message := convo.ReadMessage(messageId)
+	if message == nil || message.Read {
+		return ErrNoMessage
+	}
+
+	if message.From != ip {
+		return ErrNotSender
+	}
+
+	convo.DeleteMessage(messageId)
+	slog.Debug(
+		"message canceled",
+		"convoId", convoId,
+		"messageId", messageId,
+		"ip", ip,
+	)
+
+	// broadcast that the message was canceled
+	convo.Broadcast(Event{
+		Type: EVENT_CANCELED,
+		URL:  URL + convoId + "/" + messageId,
+		From: convo.Name(ip),
+	})
+
+	return nil
+}
 
-		// stop the pinging service
-		r.Convos[convoId].Stop <- struct{}{}
-		// remove the conversation from the room
-		delete(r.Convos, convoId)
+// EndIdleConvo ends a conversation if no message has been added or read in it
+// for longer than IdleTimeout.
+func (r *Room) EndIdleConvo(convoId string) {
+	r.Lock()
 
+	// the conversation might have been deleted since the last check
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
 		return
 	}
+	defer r.unlock(convo)
 
-	// write the user leaving notification to the remaining user
-	r.Convos[convoId].Users[OtherUserId(userId)].Write([]byte(
-		"< " + ip,
-	))
+	if convo.Clock.Now().Sub(convo.LastActivity) >= IdleTimeout {
+		r.endConvo(convoId, "conversation timed out")
+	}
 }
 
-// ReadMessage returns the raw data of the message with messageId, and deletes
-// the message from the conversation.
+// Ping is a goroutine that pings the users of every conversation in the room,
+// each conversation every convo.Interval, from one timer shared by all of
+// them. If IdleTimeout isn't zero, it also ends conversations once nothing
+// has happened in them for that long. A conversation stops being pinged as
+// soon as it's deleted from the room, and it returns once the room is closed.
 //
-// TODO: Add information to the message-read notification (like IP and time).
-//    -> see main.go for possible IP checks
-func (r *Room) ReadMessage(convoId, messageId string) ([]byte, error) {
+// TODO: This function serves to make sure the client's connection isn't closed
+//		 but there are probably better ways to do that. Check net/http settings
+//		 to see if I can change the timeout settings for the web server.
+func (r *Room) Ping() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.Clock.After(PING_TICK):
+			r.pingDue()
+		}
+	}
+}
+
+// pingDue pings the users of each conversation that hasn't pinged them for
+// its interval, then ends the ones of those that have been idle too long.
+func (r *Room) pingDue() {
+	var (
+		users []*User
+		due   []string
+	)
+
+	r.Lock()
+	now := r.Clock.Now()
+	for convoId, convo := range r.Convos {
+		if now.Sub(convo.LastPing) < convo.Interval {
+			continue
+		}
+		convo.LastPing = now
+		due = append(due, convoId)
+
+		// JSON clients don't get keepalive comments, so they always get
+		// pings, as an event they can tell apart from the others
+		for _, user := range convo.Users {
+			if user != nil && (PingDots || user.JSON) {
+				users = append(users, user)
+			}
+		}
+	}
+	r.Unlock()
+
+	// pings aren't events so they're written straight to the users instead
+	// of through an outbox, and a user too slow to take one just misses it
+	for _, user := range users {
+		user.TryWrite(Event{Type: EVENT_PING})
+	}
+
+	// check if the conversations have been idle for too long
+	if IdleTimeout > 0 {
+		for _, convoId := range due {
+			r.EndIdleConvo(convoId)
+		}
+	}
+}
+
+// EndUnjoinedConvo ends a conversation if no one has ever joined the creator.
+func (r *Room) EndUnjoinedConvo(convoId string) {
 	r.Lock()
-	defer func() {
-		// delete the message before unlocking mutex
-		delete(r.Convos[convoId].Messages, messageId)
+
+	// the creator might have left already
+	convo, ok := r.Convos[convoId]
+	if !ok {
 		r.Unlock()
-	}()
+		return
+	}
+	defer r.unlock(convo)
 
-	// check if the message exists
-	if r.Convos[convoId].ReadMessage(messageId) == nil {
-		return nil, errors.New("message doesn't exist")
+	// the second slot is only ever empty with no last ip if no one joined
+	if convo.Users[1] == nil && convo.LastIPs[1] == "" {
+		r.endConvo(convoId, "no one joined, closing")
+	}
+}
+
+// EndConvo forcibly ends a conversation, telling both users the reason. It
+// returns ErrConvoGone if the conversation doesn't exist.
+func (r *Room) EndConvo(convoId, reason string) error {
+	r.Lock()
+
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return ErrConvoGone
+	}
+	defer r.unlock(convo)
+
+	r.endConvo(convoId, reason)
+
+	return nil
+}
+
+// endConvo tells both users why the conversation is ending, ends their
+// streams, and deletes the conversation. The caller must hold the lock.
+func (r *Room) endConvo(convoId, reason string) {
+	convo := r.Convos[convoId]
+
+	// let the users know before their streams end
+	convo.Broadcast(Event{Type: EVENT_NOTICE, Text: reason})
+
+	// the users waiting for a slot aren't getting one
+	for _, user := range convo.Queue {
+		convo.Outbox = append(convo.Outbox, Delivery{
+			User:  user,
+			Event: Event{Type: EVENT_NOTICE, Text: reason},
+		})
+		convo.Ending = append(convo.Ending, user)
+	}
+	convo.Queue = nil
+
+	// remove the users, their Listen() goroutines stop once the reason has
+	// been written to them
+	for userId, user := range convo.Users {
+		if user == nil {
+			continue
+		}
+
+		convo.Users[userId] = nil
+		convo.Ending = append(convo.Ending, user)
+
+		if !r.hasIP(user.IP) {
+			PutLimiter.Forget(user.IP)
+			TypingLimiter.Forget(user.IP)
+			ReadLimiter.Forget(user.IP)
+			JoinLimiter.Forget(user.IP)
+		}
+	}
+
+	// stop the expiring and join services, and removing it from the room
+	// stops the pinging
+	close(convo.Stop)
+	convo.Release()
+	// remove the conversation from the room
+	delete(r.Convos, convoId)
+	Stats.Add(&Stats.ConvosDeleted)
+
+	slog.Info("convo ended", "convoId", convoId, "reason", reason)
+	convo.LogSummary()
+	Hooks.Notify(HOOK_DELETED, convo)
+}
+
+// ExpireMessages deletes every message in a conversation that has outlived
+// its ttl, and broadcasts that each one is gone.
+func (r *Room) ExpireMessages(convoId string) {
+	r.Lock()
+
+	// the conversation might have been deleted since the last check
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return
+	}
+	defer r.unlock(convo)
+
+	for messageId, message := range r.Convos[convoId].Messages {
+		if !message.Expired(convo.Clock.Now()) {
+			continue
+		}
+
+		// delete the message, no one will be able to read it now
+		r.Convos[convoId].DeleteMessage(messageId)
+		slog.Debug(
+			"message expired",
+			"convoId", convoId,
+			"messageId", messageId,
+		)
+
+		// broadcast that the message expired
+		r.Convos[convoId].Broadcast(Event{
+			Type: EVENT_EXPIRED,
+			URL:  URL + convoId + "/" + messageId,
+		})
+	}
+}
+
+// AddMessage adds a new message to the conversation, and returns its
+// messageId.
+func (r *Room) AddMessage(
+	data []byte,
+	tag, contentType, convoId, ip string,
+) (string, error) {
+	r.Lock()
+
+	// the conversation might have been deleted since the caller checked
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return "", ErrConvoGone
+	}
+	defer r.unlock(convo)
+
+	messageId, err := r.Convos[convoId].AddMessage(
+		data,
+		tag,
+		contentType,
+		ip,
+	)
+	if err != nil {
+		convo.AlertFailed(ip, err)
+		return "", err
 	}
 
-	// broadcast that the message was read
-	r.Convos[convoId].Broadcast(
-		[]byte("- " + URL + convoId + "/" + messageId),
+	Stats.Add(&Stats.MessagesCreated)
+	slog.Debug(
+		"message added",
+		"convoId", convoId,
+		"messageId", messageId,
+		"ip", ip,
 	)
 
-	// return the raw content of the message
-	return r.Convos[convoId].ReadMessage(messageId), nil
+	return messageId, nil
 }
 
-// AddMessage adds a new message to the conversation.
-func (r *Room) AddMessage(data []byte, convoId, ip string) error {
+// AddMessages adds a batch of messages to the conversation, and returns their
+// messageIds. Batches don't have tags.
+func (r *Room) AddMessages(
+	messages [][]byte,
+	contentType, convoId, ip string,
+) ([]string, error) {
 	r.Lock()
-	defer r.Unlock()
 
-	return r.Convos[convoId].AddMessage(data, ip)
+	// the conversation might have been deleted since the caller checked
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return nil, ErrConvoGone
+	}
+	defer r.unlock(convo)
+
+	messageIds, err := convo.AddMessages(messages, contentType, ip)
+	if err != nil {
+		convo.AlertFailed(ip, err)
+		return nil, err
+	}
+
+	for range messageIds {
+		Stats.Add(&Stats.MessagesCreated)
+	}
+	slog.Debug(
+		"messages added",
+		"convoId", convoId,
+		"count", len(messageIds),
+		"ip", ip,
+	)
+
+	return messageIds, nil
 }
 
-// JoinConvo adds a user to a conversation.
-func (r *Room) JoinConvo(user *User, convoId string) error {
+// Typing tells the other user in a conversation that the user with ip is
+// typing. It isn't a message, nothing is stored and it isn't part of the
+// event sequence, so it's lost if the other user isn't connected.
+func (r *Room) Typing(convoId, ip string) error {
+	r.Lock()
+
+	// the conversation might have been deleted since the caller checked
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return ErrConvoGone
+	}
+	defer r.unlock(convo)
+
+	for _, user := range convo.Users {
+		if user != nil && user.IP != ip {
+			convo.Outbox = append(convo.Outbox, Delivery{
+				User:  user,
+				Event: Event{Type: EVENT_TYPING, From: convo.Name(ip)},
+			})
+		}
+	}
+
+	return nil
+}
+
+// JoinConvo adds a user to a conversation and queues what they need to catch
+// up on. It returns ErrConvoGone if the conversation was deleted since the
+// caller checked IsConvo. If the conversation is full and AllowQueue is set,
+// the user is put in the queue instead and it returns true.
+func (r *Room) JoinConvo(user *User, convoId string) (bool, error) {
 	r.Lock()
-	defer r.Unlock()
+
+	// the last user might have left between IsConvo and now, so check again
+	// while holding the lock
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		r.Unlock()
+		return false, ErrConvoGone
+	}
+	defer r.unlock(convo)
+
+	if convo.Kicked[user.IP] {
+		return false, ErrKicked
+	}
+
+	// the last user left and the conversation is waiting for them to come
+	// back, it's only theirs to rejoin
+	if convo.Teardown != nil {
+		if convo.LastIPs[0] != user.IP && convo.LastIPs[1] != user.IP {
+			return false, ErrConvoGone
+		}
+
+		convo.Teardown.Stop()
+		convo.Teardown = nil
+	}
+
+	// both slots sharing an IP can't tell each other apart, so unless it's
+	// allowed for testing the other slot has to be someone else
+	if !AllowSameIP {
+		for _, other := range convo.Users {
+			if other != nil && other.IP == user.IP {
+				return false, ErrSameIP
+			}
+		}
+	}
 
 	// assign the user's convoId to the new convoId
 	user.ConvoId = convoId
+	user.Joined = convo.Clock.Now()
 
-	if r.Convos[convoId].Users[0] == nil &&
-		r.Convos[convoId].Users[1] != nil {
-		// if someone is in the 1 slot assign the new user to the 0 slot
-		user.UserId = 0
-	} else if r.Convos[convoId].Users[1] == nil &&
-		// if someone is in the 0 slot assign the new user to the 1 slot
-		r.Convos[convoId].Users[0] != nil {
-		user.UserId = 1
+	// someone coming back gets their old slot, so they can catch up on what
+	// they missed
+	if userId := convo.Slot(user.IP); userId != -1 {
+		user.UserId = userId
+	} else if AllowQueue && len(convo.Queue) < QUEUE_LENGTH {
+		// wait in line for someone to leave
+		user.Queued = true
+		convo.Queue = append(convo.Queue, user)
+		// the user is told who's on the other side once a slot opens up
+		// for them
+		convo.Outbox = append(convo.Outbox, Delivery{
+			User: user,
+			Event: Event{
+				Type: EVENT_NOTICE,
+				Text: "conversation is full, waiting for a slot",
+			},
+		})
+
+		slog.Info("user queued", "convoId", convoId, "ip", user.IP)
+
+		return true, nil
 	} else {
-		// this is very bad
-		return errors.New("this is bad")
+		// someone else took the last slot since the caller checked
+		return false, ErrConvoFull
+	}
+
+	// someone new in the slot has nothing to catch up on from whoever was
+	// there before
+	returning := r.Convos[convoId].LastIPs[user.UserId] == user.IP
+	if !returning {
+		r.Convos[convoId].Backlog[user.UserId] = nil
 	}
 
-	// broadcast to the conversation that someone joined
-	r.Convos[convoId].Broadcast([]byte(fmt.Sprintf("> %s", user.IP)))
+	// tell the other user that someone joined
+	r.Convos[convoId].Send(
+		OtherUserId(user.UserId),
+		Event{
+			Type: EVENT_JOIN,
+			From: user.Name(),
+			Time: Timestamp(user.Joined),
+		},
+	)
 	// assign the new user to the conversation
 	r.Convos[convoId].Users[user.UserId] = user
+	r.Convos[convoId].LastIPs[user.UserId] = user.IP
 
-	return nil
+	// catch the user up while still holding the lock, so nothing sent to
+	// them in the meantime is missed or written twice
+	r.welcome(convo, user)
+
+	slog.Info(
+		"user joined",
+		"convoId", convoId,
+		"ip", user.IP,
+		"userId", user.UserId,
+		"returning", returning,
+	)
+	Hooks.Notify(HOOK_JOINED, convo)
+
+	return false, nil
 }
 
-// CreateConvo creates a new conversation with the user.
-//
-// TODO: More convoId collision checks/solutions?
-func (r *Room) CreateConvo(user *User) (string, error) {
+// CreateConvo creates a new conversation with the user. If password isn't
+// nil, it's needed to join the conversation. The conversation is pinged every
+// interval, or every PingInterval if interval is zero.
+func (r *Room) CreateConvo(
+	user *User,
+	password *Password,
+	interval time.Duration,
+) (string, error) {
 	var (
 		err error
 		// convoId will be populated with the new unique conversation id
 		convoId string
 	)
 
-	// attempt to create a new convoId and return the error if it fails
-	if convoId, err = NewId(nil); err != nil {
-		return "", err
-	}
-
 	r.Lock()
 	defer r.Unlock()
 
-	// check if there was a collision
-	if _, ok := r.Convos[convoId]; ok {
-		return "", errors.New("convo id overwrite")
+	// every conversation has goroutines running, so there's a ceiling on
+	// how many can exist at once
+	if MaxConvos > 0 && len(r.Convos) >= MaxConvos {
+		return "", ErrRoomFull
+	}
+	if MaxConvosPerIP > 0 && r.countIP(user.IP) >= MaxConvosPerIP {
+		return "", ErrTooManyConvos
+	}
+
+	// attempt to create a new convoId, trying again if there was a
+	// collision, and return the error if it fails
+	if convoId, err = UniqueId(nil, func(id string) bool {
+		_, ok := r.Convos[id]
+		return ok
+	}); err != nil {
+		return "", err
 	}
 
 	// assign the new user to the new conversation
 	user.ConvoId = convoId
 	// this user is the first one
 	user.UserId = 0
+	user.Joined = r.Clock.Now()
 
 	// add the convo to the room map
-	r.Convos[convoId] = &Convo{
-		ConvoId:  convoId,
-		Users:    [2]*User{user, nil},
-		Messages: make(map[string][]byte, 0),
-		Stop:     make(chan struct{}),
+	r.Convos[convoId] = NewConvo(convoId, r.Clock)
+	r.Convos[convoId].Total = &r.Bytes
+	r.Convos[convoId].Creator = user.IP
+	r.Convos[convoId].Password = password
+	if interval > 0 {
+		r.Convos[convoId].Interval = interval
 	}
+	r.Convos[convoId].Users[0] = user
+	r.Convos[convoId].LastIPs[0] = user.IP
 
-	// start the ping goroutine
-	go r.Convos[convoId].Ping()
+	// start the expire and join goroutines
+	r.Convos[convoId].Start()
 
-	println("creating " + convoId)
+	slog.Info("convo created", "convoId", convoId, "ip", user.IP)
+	Stats.Add(&Stats.ConvosCreated)
+	Hooks.Notify(HOOK_CREATED, r.Convos[convoId])
 
 	return convoId, nil
 }
 
+// Count returns the number of active conversations.
+func (r *Room) Count() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return len(r.Convos)
+}
+
+// UserCount returns the number of users connected to a conversation.
+func (r *Room) UserCount() int {
+	r.Lock()
+	defer r.Unlock()
+
+	count := 0
+	for _, convo := range r.Convos {
+		for _, user := range convo.Users {
+			if user != nil {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// Password returns the join password of a conversation, or nil if it doesn't
+// have one or doesn't exist.
+func (r *Room) Password(convoId string) *Password {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.Convos[convoId]; !ok {
+		return nil
+	}
+
+	return r.Convos[convoId].Password
+}
+
+// Summary is a snapshot of everything in the room at once.
+type Summary struct {
+	// Convos is the number of active conversations
+	Convos int `json:"convos"`
+	// Users is the number of users connected to a conversation
+	Users int `json:"users"`
+	// Messages is the number of unread messages across every conversation
+	Messages int `json:"messages"`
+}
+
+// Summary counts the conversations, users and unread messages in the room
+// while holding the lock, so the counts all agree with each other.
+func (r *Room) Summary() Summary {
+	r.Lock()
+	defer r.Unlock()
+
+	summary := Summary{Convos: len(r.Convos)}
+	for _, convo := range r.Convos {
+		for _, user := range convo.Users {
+			if user != nil {
+				summary.Users++
+			}
+		}
+		summary.Messages += convo.Unread
+	}
+
+	return summary
+}
+
+// Snapshot is everything about one conversation at once, for debugging.
+type Snapshot struct {
+	// ConvoId is the conversation's id
+	ConvoId string `json:"convoId"`
+	// Users is each user connected to the conversation
+	Users []SnapshotUser `json:"users"`
+	// Queued is the number of users waiting for a slot
+	Queued int `json:"queued"`
+	// Pending is the number of unread messages
+	Pending int `json:"pending"`
+	// CreatedAt is when the conversation was created
+	CreatedAt string `json:"createdAt"`
+	// LastActivity is when a message was last added or read
+	LastActivity string `json:"lastActivity"`
+}
+
+// SnapshotUser is a single user in a Snapshot.
+type SnapshotUser struct {
+	// UserId is the slot the user is in
+	UserId int `json:"userId"`
+	// IP is the user's IP address
+	IP string `json:"ip"`
+	// Joined is when the user joined
+	Joined string `json:"joined"`
+}
+
+// Snapshot returns everything about the conversation with convoId while
+// holding the lock, so it all agrees. It returns ErrConvoGone if the
+// conversation doesn't exist.
+func (r *Room) Snapshot(convoId string) (*Snapshot, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		return nil, ErrConvoGone
+	}
+
+	snapshot := &Snapshot{
+		ConvoId:      convoId,
+		Users:        make([]SnapshotUser, 0, len(convo.Users)),
+		Queued:       len(convo.Queue),
+		Pending:      convo.Unread,
+		CreatedAt:    Timestamp(convo.CreatedAt),
+		LastActivity: Timestamp(convo.LastActivity),
+	}
+	for userId, user := range convo.Users {
+		if user != nil {
+			snapshot.Users = append(snapshot.Users, SnapshotUser{
+				UserId: userId,
+				IP:     user.IP,
+				Joined: Timestamp(user.Joined),
+			})
+		}
+	}
+
+	return snapshot, nil
+}
+
+// HistoryEntry is a single message in the history of a conversation.
+type HistoryEntry struct {
+	// MessageId is the id of the message
+	MessageId string
+	// Seq is the position of the message in the conversation
+	Seq uint64
+	// Read is whether or not the recipient has read the message
+	Read bool
+}
+
+// History returns every message kept in a conversation, in the order they
+// were sent. It returns ErrConvoGone if the conversation doesn't exist.
+func (r *Room) History(convoId string) ([]HistoryEntry, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		return nil, ErrConvoGone
+	}
+
+	history := make([]HistoryEntry, 0, len(convo.Messages))
+	for messageId, message := range convo.Messages {
+		// expired messages are as good as gone
+		if message.Expired(convo.Clock.Now()) {
+			continue
+		}
+
+		history = append(history, HistoryEntry{
+			MessageId: messageId,
+			Seq:       message.Seq,
+			Read:      message.Read,
+		})
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Seq < history[j].Seq
+	})
+
+	return history, nil
+}
+
+// ConvoUserCount returns the number of users connected to a conversation, zero
+// if it doesn't exist.
+func (r *Room) ConvoUserCount(convoId string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.Convos[convoId]; !ok {
+		return 0
+	}
+
+	count := 0
+	for _, user := range r.Convos[convoId].Users {
+		if user != nil {
+			count++
+		}
+	}
+
+	return count
+}
+
+// ConvosForIP returns the convoIds of every conversation with a user that has
+// the ip passed as a parameter, sorted so the order doesn't change.
+func (r *Room) ConvosForIP(ip string) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	convoIds := make([]string, 0)
+	for convoId, convo := range r.Convos {
+		for _, user := range convo.Users {
+			if user != nil && user.IP == ip {
+				convoIds = append(convoIds, convoId)
+				break
+			}
+		}
+	}
+	sort.Strings(convoIds)
+
+	return convoIds
+}
+
 // IsConvo determines whether a conversation exists or not.
 func (r *Room) IsConvo(convoId string) bool {
 	r.Lock()
@@ -196,15 +1259,17 @@ func (r *Room) IsConvo(convoId string) bool {
 }
 
 // IsConvoFull determines whether a conversation is full (2 users) or not (1
-// user). It is expected that IsConvo is called before IsConvoFull, because
-// IsConvoFull just assumes a conversation exists with convoId.
-//
-// TODO: How to handle convoId's that don't exist?
-//    -> right now just checking in main.go
+// user). A conversation that doesn't exist isn't full, it might have been
+// deleted since the caller checked IsConvo, and JoinConvo reports that with
+// ErrConvoGone while holding the lock.
 func (r *Room) IsConvoFull(convoId string) bool {
 	r.Lock()
 	defer r.Unlock()
 
-	return r.Convos[convoId].Users[0] != nil &&
-		r.Convos[convoId].Users[1] != nil
+	convo, ok := r.Convos[convoId]
+	if !ok {
+		return false
+	}
+
+	return convo.Users[0] != nil && convo.Users[1] != nil
 }
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestIsConvoFullMissing(t *testing.T) {
+	room := NewRoom(RealClock{})
+
+	// the conversation can be deleted between IsConvo and IsConvoFull
+	if room.IsConvoFull("gone") {
+		t.Fatal("a conversation that doesn't exist is full")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// State is what's saved to the state file for each conversation. Users are
+// live SSE connections and can't be saved, so they're dropped and only their
+// IPs are kept. After a restart the users have to join the conversation again
+// to get a new connection, within RestoreGrace.
+type State struct {
+	// ConvoId is the unique conversation id
+	ConvoId string
+	// IPs is the IP of the last user in each slot
+	IPs [2]string
+	// Creator is the IP of the user who created the conversation
+	Creator string `json:",omitempty"`
+	// Messages contains the unread messages of the conversation
+	Messages map[string]*Message
+	// CreatedAt is when the conversation was created
+	CreatedAt time.Time
+	// Password is the hash of the join password, if there is one
+	Password *Password `json:",omitempty"`
+	// Interval is how often the conversation is pinged
+	Interval time.Duration `json:",omitempty"`
+	// Kicked is the IPs the creator kicked out
+	Kicked []string `json:",omitempty"`
+}
+
+// Save writes every conversation to the state file at path. The file is
+// written next to path and renamed over it, so a crash while saving doesn't
+// leave a half written file behind.
+func (r *Room) Save(path string) error {
+	r.Lock()
+
+	states := make([]*State, 0, len(r.Convos))
+	for convoId, convo := range r.Convos {
+		kicked := make([]string, 0, len(convo.Kicked))
+		for ip := range convo.Kicked {
+			kicked = append(kicked, ip)
+		}
+
+		states = append(states, &State{
+			ConvoId:   convoId,
+			IPs:       convo.LastIPs,
+			Creator:   convo.Creator,
+			Messages:  convo.Messages,
+			Password:  convo.Password,
+			CreatedAt: convo.CreatedAt,
+			Interval:  convo.Interval,
+			Kicked:    kicked,
+		})
+	}
+
+	// encode while still holding the lock, the message maps belong to the
+	// conversations
+	data, err := json.Marshal(states)
+
+	r.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// Load reads the conversations in the state file at path back into the room.
+// A missing state file isn't an error, it just means there's nothing to load.
+func (r *Room) Load(path string) error {
+	var (
+		data   []byte
+		err    error
+		states []*State
+	)
+
+	if data, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, state := range states {
+		convo := NewConvo(state.ConvoId, r.Clock)
+		convo.LastIPs = state.IPs
+		convo.Password = state.Password
+		for _, ip := range state.Kicked {
+			convo.Kicked[ip] = true
+		}
+		// older state files don't have it, the creator started in the
+		// first slot
+		convo.Creator = state.Creator
+		if convo.Creator == "" {
+			convo.Creator = state.IPs[0]
+		}
+		// older state files don't have it, so use the server default
+		if state.Interval > 0 {
+			convo.Interval = state.Interval
+		}
+		// older state files don't have it, so keep the restore time
+		if !state.CreatedAt.IsZero() {
+			convo.CreatedAt = state.CreatedAt
+		}
+		if state.Messages != nil {
+			convo.Messages = state.Messages
+		}
+		for _, message := range convo.Messages {
+			if message.Read {
+				convo.History += int64(len(message.Data))
+			} else {
+				convo.Unread++
+				convo.Bytes += int64(len(message.Data))
+			}
+			r.Bytes += int64(len(message.Data))
+			// new messages have to come after the restored ones
+			if message.Seq > convo.MessageSeq {
+				convo.MessageSeq = message.Seq
+			}
+		}
+
+		// the conversation has no users, but it still needs to expire its
+		// messages while it waits for them to come back
+		r.Convos[state.ConvoId] = convo
+		convo.Total = &r.Bytes
+		convo.Start()
+
+		// it's only theirs to rejoin, the same as after the last user
+		// leaves, and it's deleted if neither of them does in time
+		convo.Teardown = convo.Clock.AfterFunc(RestoreGrace, func() {
+			r.teardown(convo)
+		})
+
+		slog.Info("convo restored", "convoId", state.ConvoId)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadRoom loads states into a new room through a state file.
+func loadRoom(t *testing.T, states []*State) *Room {
+	t.Helper()
+
+	data, err := json.Marshal(states)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	room := NewRoom(RealClock{})
+	if err = room.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(room.Close)
+
+	return room
+}
+
+// userAt returns a user connecting from ip.
+func userAt(ip string) *User {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = ip + ":1234"
+
+	return NewUser(httptest.NewRecorder(), r)
+}
+
+func TestLoadOnlyLastIPsRejoin(t *testing.T) {
+	room := loadRoom(t, []*State{{
+		ConvoId: "restored",
+		IPs:     [2]string{"10.0.0.1", "10.0.0.2"},
+	}})
+
+	_, err := room.JoinConvo(userAt("10.0.0.3"), "restored")
+	if err != ErrConvoGone {
+		t.Fatalf("stranger joining got %v, want %v", err, ErrConvoGone)
+	}
+	if _, err = room.JoinConvo(userAt("10.0.0.2"), "restored"); err != nil {
+		t.Fatalf("last user rejoining got %v", err)
+	}
+}
+
+func TestLoadTeardown(t *testing.T) {
+	setGlobal(t, &RestoreGrace, time.Millisecond*10)
+	room := loadRoom(t, []*State{{
+		ConvoId: "restored",
+		IPs:     [2]string{"10.0.0.1", ""},
+		Messages: map[string]*Message{
+			"message": {
+				Seq:     1,
+				Data:    []byte("hello"),
+				Expires: time.Now().Add(time.Hour),
+			},
+		},
+	}})
+
+	// no one came back, so it's deleted along with its messages
+	deadline := time.Now().Add(STREAM_TIMEOUT)
+	for room.IsConvo("restored") {
+		if time.Now().After(deadline) {
+			t.Fatal("restored conversation wasn't torn down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	room.Lock()
+	defer room.Unlock()
+	if room.Bytes != 0 {
+		t.Fatalf("room holds %d bytes, want 0", room.Bytes)
+	}
+}
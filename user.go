@@ -1,53 +1,253 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// NICK_HEADER is the header a user can set when creating or joining a
+	// conversation to be known by a nickname instead of their IP
+	NICK_HEADER = "X-Convo-From"
+	// MAX_NICK_LENGTH is the longest nickname a user can have
+	MAX_NICK_LENGTH = 32
+	// ANONYMOUS_NICK is who a user without a nickname is when Anonymous is
+	// set
+	ANONYMOUS_NICK = "anonymous"
+	// PSEUDONYM_PREFIX and PSEUDONYM_LENGTH are what a hidden IP is replaced
+	// with, the prefix followed by that many hex characters of its hash
+	PSEUDONYM_PREFIX = "peer-"
+	PSEUDONYM_LENGTH = 8
+)
+
+// ErrBadNick is returned when a nickname is too long or isn't printable.
+var ErrBadNick = errors.New("nickname is too long or has invalid characters")
+
+var (
+	// Anonymous is whether or not users without a nickname are called
+	// ANONYMOUS_NICK in notifications instead of by their IP.
+	Anonymous bool
+	// HideIPs is whether or not users without a nickname are called by a
+	// pseudonym in notifications instead of by their IP.
+	HideIPs bool
+	// pseudonymKey keys the hash pseudonyms are made from, it's random so
+	// no one can hash every IP to find out whose pseudonym is whose
+	pseudonymKey []byte = NewPseudonymKey()
 )
 
 // User is the struct for each connected client.
 type User struct {
-	// Pipe is the raw data channel for sending data to the user
-	Pipe chan []byte
-	// Stop is the channel for stopping the Listen() goroutine
+	// Pipe is the buffered channel for sending events to the user, so a slow
+	// user doesn't hold up whoever is sending to them
+	Pipe chan Event
+	// Stop is closed to stop the Listen() goroutine once the user has been
+	// removed from the conversation some other way (DELETE)
 	Stop chan struct{}
+	// Done is closed once the Listen() goroutine has returned, so nothing
+	// else is written to Pipe
+	Done chan struct{}
 	// IP is the user's IP address
 	IP string
+	// Nick is the nickname the user is known by in notifications, empty if
+	// they didn't choose one
+	Nick string
 	// UserId is user's id in the parent conversation
 	UserId int
 	// ConvoId is the convoId of the parent conversation
 	ConvoId string
+	// Joined is when the user joined the conversation, by its clock
+	Joined time.Time
+	// Queued is whether or not the user is waiting for a slot in the parent
+	// conversation, UserId means nothing until they get one
+	Queued bool
 	// Writer is the open http.ResponseWriter
 	Writer http.ResponseWriter
 	// Request is the initial request
 	Request *http.Request
+	// Ids is whether or not the client understands SSE event ids, so each
+	// event is written with its id
+	Ids bool
+	// JSON is whether or not events are written as JSON objects instead of
+	// plaintext lines
+	JSON bool
+	// SSE is whether or not each event is written with an event: field named
+	// after its type and its line or object in a data: field, so EventSource
+	// clients can listen for each type
+	SSE bool
 }
 
 // NewUser creates a NewUser object with the needed http variables.
 func NewUser(w http.ResponseWriter, r *http.Request) *User {
 	return &User{
-		Pipe:    make(chan []byte),
-		IP:      GetIP(r.RemoteAddr),
+		Pipe:    make(chan Event, PipeDepth),
+		Stop:    make(chan struct{}),
+		Done:    make(chan struct{}),
+		IP:      RequestIP(r),
+		Nick:    r.Header.Get(NICK_HEADER),
 		Writer:  w,
 		Request: r,
+		// plain curl doesn't care about ids, so they're only written for
+		// clients that ask for an event stream or are resuming one
+		Ids: strings.Contains(r.Header.Get("Accept"), "text/event-stream") ||
+			r.Header.Get("Last-Event-ID") != "",
+		// plaintext is the default, JSON is opt in
+		JSON: strings.Contains(r.Header.Get("Accept"), "application/json"),
+		// only EventSource clients understand the framing
+		SSE: SSEEvents &&
+			strings.Contains(r.Header.Get("Accept"), "text/event-stream"),
+	}
+}
+
+// LastEventId returns the id of the last event a reconnecting client saw, and
+// false if it isn't reconnecting.
+func (u *User) LastEventId() (uint64, bool) {
+	lastId, err := strconv.ParseUint(
+		u.Request.Header.Get("Last-Event-ID"),
+		10,
+		64,
+	)
+
+	return lastId, err == nil
+}
+
+// CheckNick makes sure a nickname fits in a notification line, which is split
+// on spaces.
+func CheckNick(nick string) error {
+	if len(nick) > MAX_NICK_LENGTH {
+		return ErrBadNick
 	}
+
+	for i := 0; i < len(nick); i++ {
+		if nick[i] < '!' || nick[i] > '~' {
+			return ErrBadNick
+		}
+	}
+
+	return nil
+}
+
+// Name returns who the user is in notifications, their nickname if they have
+// one.
+func (u *User) Name() string {
+	if u.Nick != "" {
+		return u.Nick
+	}
+
+	return DefaultName(u.ConvoId, u.IP)
+}
+
+// DefaultName returns who someone with ip and no nickname is in notifications
+// of the conversation with convoId.
+func DefaultName(convoId, ip string) string {
+	if Anonymous {
+		return ANONYMOUS_NICK
+	}
+	if HideIPs {
+		return Pseudonym(convoId, ip)
+	}
+
+	return ip
+}
+
+// NewPseudonymKey returns a random key for hashing pseudonyms.
+func NewPseudonymKey() []byte {
+	key := make([]byte, sha256.Size)
+	// crypto/rand.Read never returns an error
+	rand.Read(key)
+	return key
+}
+
+// Pseudonym returns the name ip goes by in the conversation with convoId. It's
+// the same every time within a conversation, but different in each one so
+// users can't be followed from one conversation to the next. Pseudonyms change
+// when the server restarts.
+func Pseudonym(convoId, ip string) string {
+	mac := hmac.New(sha256.New, pseudonymKey)
+	mac.Write([]byte(convoId + "/" + ip))
+	hash := hex.EncodeToString(mac.Sum(nil))
+
+	return PSEUDONYM_PREFIX + hash[:PSEUDONYM_LENGTH]
 }
 
 // Listen is a goroutine running for as long as the client stays connected. It
 // uses SSE to send events (messages/notifications) over HTTPS.
 func (u *User) Listen() error {
 	var (
-		// flusher is for establishing a SSE connection
-		flusher http.Flusher
-		// notify waits for the user to close the connection
-		notify <-chan bool
+		// done is closed when the user closes the connection, or the server
+		// shuts down
+		done <-chan struct{} = u.Request.Context().Done()
+		// keepalive ticks whenever a keepalive comment is due, it never
+		// ticks if they're turned off
+		keepalive <-chan time.Time
+		// expired fires once the connection has been open for
+		// MaxConnectionDuration, it never fires if there's no limit
+		expired <-chan time.Time
+		// rc flushes the connection and sets its write deadlines
+		rc *http.ResponseController = http.NewResponseController(u.Writer)
+		// send writes text to the connection, giving up if the client
+		// doesn't take it within WriteTimeout
+		send = func(text string) error {
+			// not every ResponseWriter supports deadlines, those just
+			// never time out
+			if WriteTimeout > 0 {
+				rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			}
+			fmt.Fprint(u.Writer, text)
+			return rc.Flush()
+		}
+		// write writes an event to the connection
+		write = func(event Event) error {
+			var text string
 
-		ok bool
+			// write the id first so the client can resume from this event
+			if u.Ids && event.Id != 0 {
+				text = fmt.Sprintf("id: %d\n", event.Id)
+			}
+			// write the event in the format the client asked for
+			payload := event.Line()
+			if u.JSON {
+				payload = event.JSON()
+			}
+			if u.SSE {
+				// a blank line ends each event
+				text += "event: " + event.Type + "\n" +
+					"data: " + payload + "\n\n"
+			} else {
+				text += payload + "\n"
+			}
+
+			return send(text)
+		}
+		// stalled is called when the user stops taking writes, they're
+		// treated like they closed the connection
+		stalled = func(err error) {
+			slog.InfoContext(
+				u.Request.Context(),
+				"user stopped reading",
+				"convoId", u.ConvoId,
+				"ip", u.IP,
+				"err", err,
+			)
+			Store.DeleteUser(u, LEAVE_DROPPED)
+		}
 	)
 
-	// try to establish a SSE connection
-	if flusher, ok = u.Writer.(http.Flusher); !ok {
+	// Listen only runs once, so this is the only place Done is closed
+	defer close(u.Done)
+
+	// try to establish a SSE connection, the user is already in the
+	// conversation so they have to be taken out if it can't be done
+	if _, ok := u.Writer.(http.Flusher); !ok {
+		Store.DeleteUser(u, LEAVE_DROPPED)
 		return errors.New("couldn't get flusher")
 	}
 
@@ -55,38 +255,116 @@ func (u *User) Listen() error {
 	u.Writer.Header().Set("Content-Type", "text/event-stream")
 	u.Writer.Header().Set("Cache-Control", "no-cache")
 	u.Writer.Header().Set("Connection", "keep-alive")
-	u.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-
-	// create the close notifier to determine when the client closes
-	notify = u.Writer.(http.CloseNotifier).CloseNotify()
-	// this goroutine waits for the user to close the connection, and does
-	// the needed cleanup
-	go func() {
-		// wait for the user to close the connection
-		<-notify
-		// delete the user from the global Store variable
-		Store.DeleteUser(u.ConvoId, u.UserId)
-		// stop the for loop in the parent function
-		u.Stop <- struct{}{}
-
-		close(u.Pipe)
-	}()
+
+	// tell EventSource clients how long to wait before reconnecting, and
+	// flush a comment right away so the client knows the stream is live,
+	// JSON clients expect every line to be an event so they get neither
+	if !u.JSON {
+		var text string
+		if Retry > 0 {
+			text = fmt.Sprintf("retry: %d\n", Retry.Milliseconds())
+		}
+		if err := send(text + ":\n"); err != nil {
+			stalled(err)
+			return nil
+		}
+	}
+
+	// keep the connection warm with comments, which EventSource ignores,
+	// JSON clients expect every line to be an event so they don't get them
+	if Keepalive > 0 && !u.JSON {
+		ticker := time.NewTicker(Keepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	// connections can only stay open so long, the timer is stopped if the
+	// user leaves first
+	if MaxConnectionDuration > 0 {
+		timer := time.NewTimer(MaxConnectionDuration)
+		defer timer.Stop()
+		expired = timer.C
+	}
 
 	for {
 		select {
 		// new data is coming in (notification/message)
-		case data := <-u.Pipe:
-			// write the data
-			fmt.Fprintf(u.Writer, "%s\n", data)
-			flusher.Flush()
-		// time to stop
-		case <-u.Stop:
+		case event := <-u.Pipe:
+			if err := write(event); err != nil {
+				stalled(err)
+				return nil
+			}
+		// the user closed the connection, so delete the user from the
+		// global Store variable
+		//
+		// DeleteUser does nothing if the user was already deleted, so this
+		// is safe even if Stop was closed at the same time. Pipe is never
+		// closed, whoever is sending might still have the user
+		case <-done:
+			Store.DeleteUser(u, LEAVE_DROPPED)
+			return nil
+		// comments aren't shown to anyone, they just keep the connection
+		// from looking idle
+		case <-keepalive:
+			if err := send(":\n"); err != nil {
+				stalled(err)
+				return nil
+			}
+		// the connection has been open too long, so tell the user why it's
+		// ending and clean up like they closed it
+		case <-expired:
+			write(Event{Type: EVENT_NOTICE, Text: "session expired"})
+			Store.DeleteUser(u, LEAVE_EXPIRED)
 			return nil
+		// the user was already deleted, time to stop once whatever is
+		// left in the pipe (like the reason the conversation ended) has
+		// been written
+		case <-u.Stop:
+			for {
+				select {
+				case event := <-u.Pipe:
+					if write(event) != nil {
+						return nil
+					}
+				default:
+					return nil
+				}
+			}
 		}
 	}
 }
 
-// Write is a helper function for writing to the user's channel.
-func (u *User) Write(data []byte) {
-	u.Pipe <- data
+// Write is a helper function for writing to the user's channel. It never
+// blocks, if the user isn't keeping up and the channel is full the event is
+// dropped and a warning is logged. Events for a user whose Listen() has
+// returned are ignored.
+func (u *User) Write(event Event) {
+	if !u.TryWrite(event) {
+		slog.Warn(
+			"dropped event for slow user",
+			"convoId", u.ConvoId,
+			"ip", u.IP,
+			"type", event.Type,
+		)
+	}
+}
+
+// TryWrite writes to the user's channel like Write, but drops the event
+// quietly if the channel is full. It's for events that don't matter if one is
+// missed, like pings, so a slow user doesn't fill the logs. It returns false
+// if the event was dropped.
+func (u *User) TryWrite(event Event) bool {
+	// the user is gone, there's no one to read the event
+	select {
+	case <-u.Done:
+		return true
+	default:
+	}
+
+	select {
+	case u.Pipe <- event:
+		return true
+	default:
+		return false
+	}
 }
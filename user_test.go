@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockedWriter is a ResponseWriter for a client that never reads, so each
+// write only ends once its deadline passes.
+type blockedWriter struct {
+	header   http.Header
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (w *blockedWriter) Header() http.Header { return w.header }
+
+func (w *blockedWriter) WriteHeader(int) {}
+
+func (w *blockedWriter) Write([]byte) (int, error) {
+	return 0, w.block()
+}
+
+func (w *blockedWriter) Flush() { w.block() }
+
+func (w *blockedWriter) FlushError() error { return w.block() }
+
+func (w *blockedWriter) SetWriteDeadline(deadline time.Time) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.deadline = deadline
+	return nil
+}
+
+// block waits for the deadline, or for STREAM_TIMEOUT if there isn't one.
+func (w *blockedWriter) block() error {
+	w.mutex.Lock()
+	deadline := w.deadline
+	w.mutex.Unlock()
+
+	if deadline.IsZero() {
+		deadline = time.Now().Add(STREAM_TIMEOUT)
+	}
+	time.Sleep(time.Until(deadline))
+
+	return os.ErrDeadlineExceeded
+}
+
+func TestListenBlockedWriter(t *testing.T) {
+	setGlobal(t, &WriteTimeout, time.Millisecond*20)
+	server := newTestServer(t)
+	aliceStream, convoId := server.client(t, "10.0.0.1").create()
+
+	r := httptest.NewRequest("GET", "/"+convoId, nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	bob := NewUser(&blockedWriter{header: make(http.Header)}, r)
+	if _, err := Store.JoinConvo(bob, convoId); err != nil {
+		t.Fatal(err)
+	}
+	aliceStream.expect("> 10.0.0.2 ")
+
+	listened := make(chan error)
+	go func() { listened <- bob.Listen() }()
+
+	// bob never reads, so they're dropped once the first write times out
+	select {
+	case err := <-listened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(STREAM_TIMEOUT):
+		t.Fatal("Listen is still blocked on the write")
+	}
+	if line := aliceStream.expect("< 10.0.0.2 "); !strings.HasSuffix(
+		line,
+		" "+LEAVE_DROPPED,
+	) {
+		t.Fatalf("got %q, want bob to have been dropped", line)
+	}
+}
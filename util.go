@@ -1,12 +1,76 @@
 package main
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"hash/fnv"
+	"math"
 	"net"
-	"time"
+	"net/http"
+	"strings"
+	"unicode"
 )
 
+const (
+	// ID_ALPHABET is the set of characters ids are made from (lowercase
+	// base32, so ids are easy to type and don't depend on case)
+	ID_ALPHABET = "abcdefghijklmnopqrstuvwxyz234567"
+	// DEFAULT_ID_LENGTH is the number of characters in a new id, 10 base32
+	// characters is 50 bits of randomness
+	DEFAULT_ID_LENGTH = 10
+	// MIN_ID_BITS is the least randomness an id should have before it starts
+	// being practical to guess
+	MIN_ID_BITS = 40
+	// ID_ATTEMPTS is how many ids are generated before giving up on finding
+	// one that isn't taken
+	ID_ATTEMPTS = 5
+)
+
+// ErrIdCollision is returned when every id generated was already taken.
+var ErrIdCollision = errors.New("couldn't generate a unique id")
+
+var (
+	// IdLength is the number of characters in each new id.
+	IdLength int = DEFAULT_ID_LENGTH
+	// IdAlphabet is the set of characters each new id is made from.
+	IdAlphabet string = ID_ALPHABET
+	// TrustProxy is whether or not the server is behind a reverse proxy that
+	// sets X-Forwarded-For or X-Real-IP.
+	TrustProxy bool
+	// newId is what UniqueId generates ids with, tests replace it to force
+	// collisions.
+	newId = NewId
+)
+
+// CheckIdAlphabet returns an error if alphabet can't be used to make ids. Each
+// character has to be a single byte that's safe in a URL path, and can only
+// appear once so every character is equally likely.
+func CheckIdAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return errors.New("must have at least 2 characters")
+	}
+
+	seen := make(map[rune]bool, len(alphabet))
+	for _, char := range alphabet {
+		if char > unicode.MaxASCII || !unicode.IsPrint(char) ||
+			strings.ContainsRune("/?#% ", char) {
+			return fmt.Errorf("%q isn't safe in a URL", char)
+		}
+		if seen[char] {
+			return fmt.Errorf("%q appears more than once", char)
+		}
+		seen[char] = true
+	}
+
+	return nil
+}
+
+// IdBits returns how many bits of randomness an id of length characters from
+// alphabet has.
+func IdBits(length int, alphabet string) float64 {
+	return float64(length) * math.Log2(float64(len(alphabet)))
+}
+
 // OtherUserId simply returns the id of the opposite user.
 func OtherUserId(userId int) int {
 	return (^userId) + 2
@@ -16,24 +80,113 @@ func OtherUserId(userId int) int {
 // (Removes socket number.)
 func GetIP(ip string) string {
 	host, _, _ := net.SplitHostPort(ip)
-	return host
+	return NormalizeIP(host)
 }
 
-// NewId creates a new unique ID with data as the salt.
+// IsIP determines whether or not ip is an IP address.
+func IsIP(ip string) bool {
+	return net.ParseIP(ip) != nil
+}
+
+// NormalizeIP writes ip in its canonical form, so the same address always
+// compares equal (0:0:0:0:0:0:0:1 and ::1, or an IPv4 address mapped to IPv6
+// and the plain IPv4 one). Anything that isn't an IP is returned as it is.
+func NormalizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	return parsed.String()
+}
+
+// NormalizeId puts id in the case of its alphabet if the alphabet only has
+// one, so an id typed in the wrong case still finds what it's for. Otherwise
+// case matters (like a custom alphabet with "a" and "A") and id is returned as
+// it is.
+func NormalizeId(id string) string {
+	switch IdAlphabet {
+	case strings.ToLower(IdAlphabet):
+		return strings.ToLower(id)
+	case strings.ToUpper(IdAlphabet):
+		return strings.ToUpper(id)
+	}
+
+	return id
+}
+
+// UniqueId creates a new id with NewId, trying again while taken reports that
+// the id is already in use. It gives up with ErrIdCollision after ID_ATTEMPTS
+// tries.
+func UniqueId(data []byte, taken func(id string) bool) (string, error) {
+	for attempt := 0; attempt < ID_ATTEMPTS; attempt++ {
+		id, err := newId(data)
+		if err != nil {
+			return "", err
+		}
+		if !taken(id) {
+			return id, nil
+		}
+	}
+
+	return "", ErrIdCollision
+}
+
+// RequestIP returns the IP of the client that made the request. Behind a
+// trusted proxy that's the last hop of X-Forwarded-For (the one the proxy
+// added, anything before it came from the client and can be spoofed), or
+// X-Real-IP. Otherwise the headers are ignored, since anyone can set them.
+// A header that isn't an IP is ignored too, the IP is used as a map key all
+// over the place and arbitrary text shouldn't end up there.
+func RequestIP(r *http.Request) string {
+	if TrustProxy {
+		// the proxy appends the address it saw to the end of the header
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); IsIP(ip) {
+			return NormalizeIP(ip)
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); IsIP(ip) {
+			return NormalizeIP(ip)
+		}
+	}
+
+	return GetIP(r.RemoteAddr)
+}
+
+// NewId creates a new random ID using crypto/rand, so ids can't be guessed
+// from the time they were created.
+//
+// The data parameter used to be the salt for the old fnv hash ids, it's no
+// longer needed but callers still pass it.
 func NewId(data []byte) (string, error) {
 	var (
-		now   []byte
-		err   error
-		fhash = fnv.New32a()
+		err error
+		// id will be populated with random characters from IdAlphabet
+		id = make([]byte, IdLength)
+		// buf holds the random bytes each character is picked from
+		buf = make([]byte, IdLength)
+		// limit is the largest multiple of len(IdAlphabet) that fits in a
+		// byte, anything at or above it is thrown away so every character is
+		// equally likely
+		limit = 256 - (256 % len(IdAlphabet))
 	)
 
-	// get the current time
-	if now, err = time.Now().MarshalBinary(); err != nil {
-		return "", err
-	}
+	for i := 0; i < IdLength; {
+		// get a fresh batch of random bytes
+		if _, err = rand.Read(buf); err != nil {
+			return "", err
+		}
 
-	// append the salt to the time
-	fhash.Write(append(now[:], data[:]...))
+		for _, b := range buf {
+			if i == IdLength {
+				break
+			}
+			if int(b) < limit {
+				id[i] = IdAlphabet[int(b)%len(IdAlphabet)]
+				i++
+			}
+		}
+	}
 
-	return fmt.Sprintf("%d", fhash.Sum32()), nil
+	return string(id), nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewId(t *testing.T) {
+	const count = 10000
+
+	seen := make(map[string]bool, count)
+	for i := 0; i < count; i++ {
+		id, err := NewId(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(id) != IdLength {
+			t.Fatalf("id %q has length %d, want %d", id, len(id), IdLength)
+		}
+		for _, char := range id {
+			if !strings.ContainsRune(IdAlphabet, char) {
+				t.Fatalf("id %q has %q, which isn't in the alphabet", id, char)
+			}
+		}
+		if seen[id] {
+			t.Fatalf("id %q was generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRequestIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trust   bool
+		forward string
+		real    string
+		want    string
+	}{
+		{"no headers", true, "", "", "192.0.2.1"},
+		{"one hop", true, "10.0.0.1", "", "10.0.0.1"},
+		{"proxy hop is last", true, "10.0.0.1, 10.0.0.2", "", "10.0.0.2"},
+		{"spoofed hops", true, "1.1.1.1,2.2.2.2 , 10.0.0.3", "", "10.0.0.3"},
+		{"spoofed last hop", true, "10.0.0.1, evil", "", "192.0.2.1"},
+		{"real ip", true, "", "10.0.0.4", "10.0.0.4"},
+		{"forwarded first", true, "10.0.0.1", "10.0.0.4", "10.0.0.1"},
+		{"bad real ip", true, "", "evil", "192.0.2.1"},
+		{"normalized", true, "2001:DB8::0:1", "", "2001:db8::1"},
+		{"untrusted forward", false, "10.0.0.1, 10.0.0.2", "", "192.0.2.1"},
+		{"untrusted real ip", false, "", "10.0.0.4", "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setGlobal(t, &TrustProxy, test.trust)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if test.forward != "" {
+				r.Header.Set("X-Forwarded-For", test.forward)
+			}
+			if test.real != "" {
+				r.Header.Set("X-Real-IP", test.real)
+			}
+
+			if ip := RequestIP(r); ip != test.want {
+				t.Fatalf("got %q, want %q", ip, test.want)
+			}
+		})
+	}
+}
+
+func TestUniqueId(t *testing.T) {
+	// hand out the same ids over and over
+	ids := []string{"taken", "taken", "free"}
+	calls := 0
+	setGlobal(t, &newId, func([]byte) (string, error) {
+		id := ids[calls%len(ids)]
+		calls++
+		return id, nil
+	})
+	taken := func(id string) bool { return id == "taken" }
+
+	id, err := UniqueId(nil, taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "free" || calls != 3 {
+		t.Fatalf("got %q after %d tries, want %q after 3", id, calls, "free")
+	}
+
+	// every id is taken, so it gives up
+	calls = 0
+	ids = []string{"taken"}
+	if _, err = UniqueId(nil, taken); err != ErrIdCollision {
+		t.Fatalf("got %v, want %v", err, ErrIdCollision)
+	}
+	if calls != ID_ATTEMPTS {
+		t.Fatalf("gave up after %d tries, want %d", calls, ID_ATTEMPTS)
+	}
+}
+
+func TestNewIdNilSalt(t *testing.T) {
+	for _, data := range [][]byte{nil, {}} {
+		id, err := NewId(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != IdLength {
+			t.Fatalf("id %q has length %d, want %d", id, len(id), IdLength)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	server := newTestServer(t)
+	// the same addresses, spelled differently than they're checked with
+	ipv6 := server.client(t, "2001:0DB8:0000:0000:0000:0000:0000:0001")
+	_, convoId := ipv6.create()
+	_, mappedId := server.client(t, "::ffff:10.0.0.1").create()
+
+	for _, ip := range []string{
+		"2001:db8::1",
+		"2001:DB8::1",
+		"2001:db8:0:0:0:0:0:1",
+		"2001:0db8::0001",
+		"2001:db8::0:1",
+	} {
+		if !Store.IPExists(convoId, NormalizeIP(ip)) {
+			t.Errorf("%s isn't in the conversation", ip)
+		}
+	}
+	for _, ip := range []string{"10.0.0.1", "::ffff:10.0.0.1", "::FFFF:a00:1"} {
+		if !Store.IPExists(mappedId, NormalizeIP(ip)) {
+			t.Errorf("%s isn't in the conversation", ip)
+		}
+	}
+
+	if ip := NormalizeIP("not an ip"); ip != "not an ip" {
+		t.Errorf("got %q, want it unchanged", ip)
+	}
+}
+
+func TestNormalizeId(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		id       string
+		want     string
+	}{
+		{"abcdef", "AbC", "abc"},
+		{"ABCDEF", "aBc", "ABC"},
+		{"0123456789", "123", "123"},
+		{"abcABC", "aBc", "aBc"},
+	}
+
+	for _, test := range tests {
+		setGlobal(t, &IdAlphabet, test.alphabet)
+		if id := NormalizeId(test.id); id != test.want {
+			t.Errorf(
+				"NormalizeId(%q) with %q = %q, want %q",
+				test.id, test.alphabet, id, test.want,
+			)
+		}
+	}
+}
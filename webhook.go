@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// WEBHOOK_QUEUE_LENGTH is how many hooks can wait to be sent before new
+	// ones are dropped
+	WEBHOOK_QUEUE_LENGTH = 1024
+	// WEBHOOK_TIMEOUT is how long each attempt to send a hook can take
+	WEBHOOK_TIMEOUT = time.Second * 5
+	// WEBHOOK_ATTEMPTS is how many times a hook is sent before giving up,
+	// waiting twice as long after each failed attempt
+	WEBHOOK_ATTEMPTS = 3
+	// WEBHOOK_BACKOFF is how long to wait after the first failed attempt
+	WEBHOOK_BACKOFF = time.Second
+
+	// the types of hook
+	HOOK_CREATED = "created"
+	HOOK_JOINED  = "joined"
+	HOOK_MESSAGE = "message"
+	HOOK_DELETED = "deleted"
+)
+
+// Hook is what's posted to the webhook when something happens in a
+// conversation.
+type Hook struct {
+	// Type is what happened, one of the HOOK_ types
+	Type string `json:"type"`
+	// ConvoId is the conversation it happened in
+	ConvoId string `json:"convoId"`
+	// IPs is the IP of each user who has been in the conversation
+	IPs []string `json:"ips"`
+	// Time is when it happened
+	Time string `json:"time"`
+}
+
+// Webhook posts hooks to a URL one at a time, so a slow endpoint only holds
+// up the hooks and never a request.
+type Webhook struct {
+	// URL is where hooks are posted, nothing is sent if it's empty
+	URL string
+	// Queue is the hooks waiting to be sent
+	Queue chan Hook
+	// Client sends the hooks
+	Client *http.Client
+}
+
+// Hooks is the global webhook.
+var Hooks = &Webhook{
+	Queue:  make(chan Hook, WEBHOOK_QUEUE_LENGTH),
+	Client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+}
+
+// Notify queues a hook for what happened in a conversation without blocking.
+// It's dropped if the queue is full, the webhook is already too far behind.
+func (h *Webhook) Notify(hookType string, convo *Convo) {
+	if h.URL == "" {
+		return
+	}
+
+	hook := Hook{
+		Type:    hookType,
+		ConvoId: convo.ConvoId,
+		IPs:     convo.IPs(),
+		Time:    Timestamp(convo.Clock.Now()),
+	}
+
+	select {
+	case h.Queue <- hook:
+	default:
+		slog.Warn(
+			"webhook queue full, dropping hook",
+			"type", hookType,
+			"convoId", convo.ConvoId,
+		)
+	}
+}
+
+// Run is a goroutine that sends each queued hook, trying again with backoff
+// when the endpoint fails.
+func (h *Webhook) Run() {
+	for hook := range h.Queue {
+		var (
+			err     error
+			backoff = WEBHOOK_BACKOFF
+		)
+
+		for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+			if err = h.Send(hook); err == nil {
+				break
+			}
+			if attempt < WEBHOOK_ATTEMPTS {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+
+		if err != nil {
+			slog.Warn(
+				"couldn't send hook",
+				"type", hook.Type,
+				"convoId", hook.ConvoId,
+				"err", err,
+			)
+		}
+	}
+}
+
+// Send posts a single hook to the webhook as JSON. Anything but a 2xx status
+// is an error.
+func (h *Webhook) Send(hook Hook) error {
+	// a Hook only has strings so this can't fail
+	data, _ := json.Marshal(hook)
+
+	resp, err := h.Client.Post(h.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}